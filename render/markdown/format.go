@@ -0,0 +1,29 @@
+package markdown
+
+import (
+	"bytes"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/mmarkdown/mmark/mparser"
+)
+
+// Format parses the mmark document in src and returns it as normalized markdown. Includes are not
+// expanded, they are kept as is. An error is returned if the document contains nodes that can't be
+// rendered, the returned markdown lacks those.
+func Format(src []byte, opts RendererOptions) ([]byte, error) {
+	p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+	p.Opts = parser.Options{ParserHook: mparser.TitleHook}
+
+	doc := markdown.Parse(src, p)
+	r := NewRenderer(opts)
+	out := markdown.Render(doc, r)
+	return out, r.Err()
+}
+
+// Check formats src and reports if src was already formatted. The formatted document is returned in
+// normalized.
+func Check(src []byte, opts RendererOptions) (formatted bool, normalized []byte, err error) {
+	normalized, err = Format(src, opts)
+	return bytes.Equal(src, normalized), normalized, err
+}
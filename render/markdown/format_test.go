@@ -0,0 +1,148 @@
+package markdown
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	in := `%%%
+title = "Example"
+
+[seriesInfo]
+name = "Internet-Draft"
+value = "draft-example-00"
+%%%
+
+.# Abstract
+
+This is   the abstract.
+
+{mainmatter}
+
+# Introduction {#intro}
+
+Some *emphasis*, **strong** and ` + "`code`" + `, with a citation [@RFC2119]
+and a cross reference to (#intro).
+
+* one
+* two
+
+1. first
+2. second
+
+~~~ go
+x := 1
+~~~
+Figure: A code block.
+
+> A quote.
+
+Name | Age
+-----|----
+Bob | 12
+Table: Ages.
+
+{backmatter}
+`
+	out := `%%%
+title = "Example"
+
+[seriesInfo]
+name = "Internet-Draft"
+value = "draft-example-00"
+%%%
+
+.# Abstract
+
+This is the abstract.
+
+{mainmatter}
+
+# Introduction {#intro}
+
+Some *emphasis*, **strong** and ` + "`code`" + `, with a citation [@RFC2119] and a cross
+reference to (#intro).
+
+ *  one
+ *  two
+
+1.  first
+2.  second
+
+~~~ go
+x := 1
+~~~
+Figure: A code block.
+
+> A quote.
+
+Name | Age
+-----|-----
+Bob  | 12
+Table: Ages.
+
+{backmatter}
+`
+
+	got, err := Format([]byte(in), RendererOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Errorf("Expected:\n%s\ngot:\n%s", out, got)
+	}
+
+	// formatting again should not change anything.
+	again, err := Format(got, RendererOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(got) {
+		t.Errorf("Expected:\n%s\ngot:\n%s", got, again)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		in        string
+		formatted bool
+	}{
+		{"# Introduction\n\nSome *emphasis* and a list:\n\n *  one\n *  two\n", true},
+		{"Introduction\n============\n\nSome _emphasis_   and a list:\n\n- one\n- two\n", false},
+	}
+	for i, tc := range tests {
+		formatted, normalized, err := Check([]byte(tc.in), RendererOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatted != tc.formatted {
+			t.Errorf("Test %d, expected formatted to be %t, got %t:\n%s", i, tc.formatted, formatted, normalized)
+		}
+		if again, _, _ := Check(normalized, RendererOptions{}); !again {
+			t.Errorf("Test %d, expected normalized output to be formatted:\n%s", i, normalized)
+		}
+	}
+}
+
+func TestValidateCategory(t *testing.T) {
+	tests := []struct {
+		status string
+		err    bool
+	}{
+		{"informational", false},
+		{"standard", false},
+		{"nonsense", true},
+	}
+	for i, tc := range tests {
+		in := "%%%\ntitle = \"Example\"\n\n[seriesInfo]\nname = \"RFC\"\nvalue = \"9999\"\nstatus = \"" + tc.status + "\"\n%%%\n\nText.\n"
+		out, err := Format([]byte(in), RendererOptions{ValidateCategory: true})
+		if (err != nil) != tc.err {
+			t.Errorf("Test %d, expected error to be %t, got %v", i, tc.err, err)
+		}
+		// the title block is always preserved.
+		if string(out) != in {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, in, out)
+		}
+	}
+	if _, err := Format([]byte("%%%\ntitle = \"Example\"\n\n[seriesInfo]\nstatus = \"nonsense\"\n%%%\n"), RendererOptions{}); err != nil {
+		t.Errorf("Expected no error without ValidateCategory, got %v", err)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"io"
 	"regexp"
+	"sort"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/mmarkdown/mmark/internal/text"
+	"github.com/mmarkdown/mmark/mast"
 )
 
 func (r *Renderer) outOneOf(w io.Writer, outFirst bool, first, second string) {
@@ -27,7 +30,9 @@ func (r *Renderer) newline(w io.Writer) {
 	if r.suppress {
 		return
 	}
-	r.out(w, r.prefix.flatten())
+	if !r.opts.EmptyPrefixLines {
+		r.out(w, r.prefix.flatten())
+	}
 	r.outs(w, "\n")
 	r.suppress = true
 }
@@ -37,13 +42,355 @@ var re = regexp.MustCompile("  +")
 // lastNode returns true if we are the last node under this parent.
 func lastNode(node ast.Node) bool { return ast.GetNextNode(node) == nil }
 
+// blockEnd is called when a block has been rendered, it emits the blank line that separates node
+// from the next block. For the last node nothing is emitted, the parent's blockEnd takes care of
+// this, after it has removed its prefix. A caption directly follows its block, except for a quote,
+// where it would otherwise be taken as a continuation of the quote, and with CommonMarkStrict, where
+// the caption is a paragraph.
+func (r *Renderer) blockEnd(w io.Writer, node ast.Node) {
+	next := ast.GetNextNode(node)
+	if next == nil {
+		return
+	}
+	if _, ok := next.(*ast.Footnotes); ok {
+		// the footnotes aren't rendered here, but at the end of the document.
+		return
+	}
+	_, isCaption := next.(*ast.Caption)
+	_, isQuote := node.(*ast.BlockQuote)
+	if isCaption && !isQuote && !r.opts.CommonMarkStrict {
+		return
+	}
+	if _, isList := next.(*ast.List); isList && r.opts.BlankBeforeList {
+		r.newline(w)
+		return
+	}
+	if tight(node) {
+		return
+	}
+	r.newline(w)
+}
+
+// tight returns true if node is a list item of a tight list, or a block directly under such a list
+// item. Definition lists are never tight.
+func tight(node ast.Node) bool {
+	item, ok := node.(*ast.ListItem)
+	if !ok {
+		if item, ok = node.GetParent().(*ast.ListItem); !ok {
+			return false
+		}
+	}
+	list, ok := item.Parent.(*ast.List)
+	if !ok {
+		return false
+	}
+	return list.Tight && list.ListFlags&ast.ListTypeDefinition == 0
+}
+
+// blankInItem returns true if BlankBeforeList puts an empty line before a list nested in one of the
+// items of list.
+func (r *Renderer) blankInItem(list *ast.List) bool {
+	if !r.opts.BlankBeforeList {
+		return false
+	}
+	for _, item := range list.Children {
+		for _, c := range item.GetChildren() {
+			if _, isList := c.(*ast.List); isList && ast.GetPrevNode(c) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // wrapText wraps the text in data, taking len(prefix) into account.
 func (r *Renderer) wrapText(data, prefix []byte) []byte {
+	data = protectCodeSpans(data)
 	replaced := re.ReplaceAll(data, []byte(" "))
-	wrapped := text.WrapBytes(replaced, r.opts.TextWidth-len(prefix))
+	var wrapped []byte
+	switch r.opts.WrapMode {
+	case WrapNone:
+		wrapped = bytes.Join(words(replaced), []byte(" "))
+	case WrapSentence:
+		wrapped = wrapSentence(replaced)
+	case WrapPreserve:
+		lines := bytes.Split(bytes.TrimSpace(replaced), []byte("\n"))
+		for i := range lines {
+			lines[i] = bytes.TrimSpace(lines[i])
+		}
+		wrapped = bytes.Join(lines, []byte("\n"))
+	default:
+		wrapped = WrapText(replaced, r.opts.TextWidth-len(prefix), nil)
+	}
+	wrapped = escapeLineStart(wrapped)
+	wrapped = bytes.Replace(wrapped, []byte{codeSpace}, []byte(" "), -1)
 	return r.indentText(wrapped, prefix)
 }
 
+// codeSpace replaces the whitespace in code spans while wrapping, see protectCodeSpans.
+const codeSpace = '\x1a'
+
+// protectCodeSpans replaces the spaces and newlines in the code spans in data with codeSpace. This makes
+// sure a code span is never wrapped, which could otherwise lead to an escape inside the code.
+// In a code span a newline is equivalent to a space.
+func protectCodeSpans(data []byte) []byte {
+	var ret []byte
+	for i := 0; i < len(data); {
+		if data[i] != '`' || (i > 0 && data[i-1] == '\\') {
+			i++
+			continue
+		}
+		n := backtickRun(data, i)
+		end := codeSpanEnd(data, i)
+		if end < 0 {
+			i += n
+			continue
+		}
+		if ret == nil {
+			ret = append([]byte{}, data...)
+		}
+		for j := i + n; j < end; j++ {
+			if ret[j] == ' ' || ret[j] == '\n' {
+				ret[j] = codeSpace
+			}
+		}
+		i = end + n
+	}
+	if ret == nil {
+		return data
+	}
+	return ret
+}
+
+// codeSpanEnd returns the index of the backticks that close the code span starting at i in data, or -1
+// if the code span isn't closed.
+func codeSpanEnd(data []byte, i int) int {
+	n := backtickRun(data, i)
+	for j := i + n; j < len(data); {
+		if data[j] != '`' {
+			j++
+			continue
+		}
+		m := backtickRun(data, j)
+		if m == n {
+			return j
+		}
+		j += m
+	}
+	return -1
+}
+
+// backtickRun returns the number of backticks in data starting at i.
+func backtickRun(data []byte, i int) int {
+	n := 0
+	for i+n < len(data) && data[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// WrapText wraps text in lines of at most width characters, taking the length of prefix into account,
+// and puts prefix in front of each line. Newlines in text are treated as spaces. Words longer than the
+// width are not broken up. If prefix leaves no room for text, each word is put on its own line.
+func WrapText(data []byte, width int, prefix []byte) []byte {
+	var wrapped []byte
+	if lim := width - len(prefix); lim < 1 {
+		wrapped = bytes.Join(words(data), []byte("\n"))
+	} else {
+		wrapped = text.WrapBytes(data, lim)
+	}
+	return text.IndentBytes(wrapped, prefix)
+}
+
+// words returns the words in data, newlines are treated as spaces.
+func words(data []byte) [][]byte {
+	data = bytes.Replace(bytes.TrimSpace(data), []byte("\n"), []byte(" "), -1)
+	return bytes.Fields(data)
+}
+
+// wrapSentence puts each sentence in data on its own line.
+func wrapSentence(data []byte) []byte {
+	w := words(data)
+	var lines [][]byte
+	begin := 0
+	for i := range w {
+		if i == len(w)-1 || (sentenceEnd(w[i]) && startsUpper(w[i+1])) {
+			lines = append(lines, bytes.Join(w[begin:i+1], []byte(" ")))
+			begin = i + 1
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// sentenceEnd returns true if word ends a sentence, i.e. it ends in '.', '?' or '!', possibly followed by
+// closing quotes or parentheses. Abbreviations, like "e.g." and "etc.", don't end a sentence.
+func sentenceEnd(word []byte) bool {
+	word = bytes.TrimRight(word, `"')]*_`)
+	if len(word) < 2 {
+		return false
+	}
+	switch word[len(word)-1] {
+	case '?', '!':
+		return true
+	case '.':
+	default:
+		return false
+	}
+	word = word[:len(word)-1]
+	if bytes.IndexByte(word, '.') >= 0 { // e.g, i.e, U.S
+		return false
+	}
+	if len(word) == 1 && unicode.IsUpper(rune(word[0])) { // initials, J. Doe
+		return false
+	}
+	_, ok := abbreviations[string(bytes.ToLower(word))]
+	return !ok
+}
+
+// startsUpper returns true if word starts with an upper case letter, skipping opening quotes and parentheses.
+func startsUpper(word []byte) bool {
+	word = bytes.TrimLeft(word, `"'([*_`)
+	if len(word) == 0 {
+		return false
+	}
+	r, _ := utf8.DecodeRune(word)
+	return unicode.IsUpper(r)
+}
+
+// abbreviations that end in a dot, but don't end a sentence.
+var abbreviations = map[string]struct{}{
+	"al": {}, "cf": {}, "dr": {}, "etc": {}, "fig": {}, "mr": {}, "mrs": {}, "ms": {}, "no": {}, "sec": {}, "vs": {},
+}
+
+// escapeLineStart escapes the characters at the start of each line in data that would otherwise
+// be parsed as the start of a block, i.e. a heading, quote, aside or a list.
+func escapeLineStart(data []byte) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, l := range lines {
+		j := lineStartEscape(l)
+		if j < 0 {
+			continue
+		}
+		escaped := make([]byte, 0, len(l)+1)
+		escaped = append(escaped, l[:j]...)
+		escaped = append(escaped, '\\')
+		lines[i] = append(escaped, l[j:]...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// lineStartEscape returns the index in l where a backslash should be inserted, or -1 if nothing
+// needs to be escaped.
+func lineStartEscape(l []byte) int {
+	if len(l) == 0 {
+		return -1
+	}
+	spaceAfter := func(i int) bool { return i >= len(l) || l[i] == ' ' }
+
+	switch l[0] {
+	case '#', '>':
+		return 0
+	case '-', '+', '*', ':':
+		if spaceAfter(1) {
+			return 0
+		}
+	case '.':
+		if len(l) > 1 && l[1] == '#' {
+			return 1
+		}
+	case 'A':
+		if len(l) > 1 && l[1] == '>' {
+			return 1
+		}
+	case '~', '`':
+		// a complete code span, see protectCodeSpans, doesn't start a fenced code block.
+		if len(l) > 2 && l[1] == l[0] && l[2] == l[0] && (l[0] == '~' || codeSpanEnd(l, 0) < 0) {
+			return 0
+		}
+	}
+	if isRule(l) || isUnderline(l) {
+		return 0
+	}
+
+	// ordered list: 1. or 1)
+	i := 0
+	for i < len(l) && i < 10 && l[i] >= '0' && l[i] <= '9' {
+		i++
+	}
+	if i > 0 && i < len(l) && (l[i] == '.' || l[i] == ')') && spaceAfter(i+1) {
+		return i
+	}
+	return -1
+}
+
+// isUnderline returns true if l would be parsed as the underline of a setext heading, when it follows
+// a line of text.
+func isUnderline(l []byte) bool {
+	c := l[0]
+	if c != '=' && c != '-' {
+		return false
+	}
+	return len(bytes.TrimRight(l, string(c)+" ")) == 0
+}
+
+// isRule returns true if l would be parsed as a horizontal rule.
+func isRule(l []byte) bool {
+	c := l[0]
+	if c != '-' && c != '*' && c != '_' {
+		return false
+	}
+	n := 0
+	for i := range l {
+		switch l[i] {
+		case c:
+			n++
+		case ' ':
+		default:
+			return false
+		}
+	}
+	return n >= 3
+}
+
+// autolink returns the text of link if it is an autolink, i.e. the link's only child is text that is
+// equal to the destination (or the destination without mailto:) and it has no title. Otherwise nil is
+// returned. Only a destination with a scheme, i.e. https: or mailto:, is parsed back as an autolink.
+func autolink(link *ast.Link) []byte {
+	if len(link.Title) > 0 || len(link.DeferredID) > 0 || !hasScheme(link.Destination) {
+		return nil
+	}
+	children := link.GetChildren()
+	if len(children) != 1 {
+		return nil
+	}
+	text, ok := children[0].(*ast.Text)
+	if !ok {
+		return nil
+	}
+	if bytes.Equal(text.Literal, link.Destination) {
+		return text.Literal
+	}
+	if bytes.HasPrefix(link.Destination, []byte("mailto:")) && bytes.Equal(text.Literal, link.Destination[7:]) {
+		return text.Literal
+	}
+	return nil
+}
+
+// hasScheme returns true if dest is an absolute URI, i.e. it starts with a scheme followed by a colon, and
+// it holds nothing that ends an autolink.
+func hasScheme(dest []byte) bool {
+	if bytes.ContainsAny(dest, " \t\n<>'\"") {
+		return false
+	}
+	i := 0
+	for i < len(dest) && (isAlnum(dest[i]) || (i > 0 && (dest[i] == '.' || dest[i] == '+' || dest[i] == '-'))) {
+		i++
+	}
+	return i > 1 && i < len(dest) && dest[i] == ':'
+}
+
+// indentText prepends prefix to each line in data. Tabs in data are not expanded, which is important for
+// code, think Makefiles.
 func (r *Renderer) indentText(data, prefix []byte) []byte {
 	return text.IndentBytes(data, prefix)
 }
@@ -119,6 +466,200 @@ func (p *prefixStack) len() (l int) {
 	return l
 }
 
+// escapeByte escapes all unescaped occurrences of c in data with a backslash.
+func escapeByte(data []byte, c byte) []byte {
+	ret := make([]byte, 0, len(data))
+	for i := range data {
+		if data[i] == c && (i == 0 || data[i-1] != '\\') {
+			ret = append(ret, '\\')
+		}
+		ret = append(ret, data[i])
+	}
+	return ret
+}
+
+// emphasis returns the delimiter for the emphasis or strong node. This is *, or with MinimalEmphasis,
+// _ when that is unambiguous. An emphasis holding strong text also uses _, because *a **b** c* isn't
+// parsed as such.
+func (r *Renderer) emphasis(node ast.Node) string {
+	c := "*"
+	if r.opts.MinimalEmphasis && underscore(node) {
+		c = "_"
+	}
+	if _, ok := node.(*ast.Emph); ok && hasStrong(node) && underscore(node) {
+		c = "_"
+	}
+	if _, ok := node.(*ast.Strong); ok {
+		return c + c
+	}
+	return c
+}
+
+// underscore returns true if _ can be used as the delimiter for the emphasis in node. This is not the
+// case if the emphasis is inside a word, its text starts or ends with an underscore or the enclosing
+// emphasis already uses an underscore.
+func underscore(node ast.Node) bool {
+	if prev, ok := ast.GetPrevNode(node).(*ast.Text); ok && len(prev.Literal) > 0 && isAlnum(prev.Literal[len(prev.Literal)-1]) {
+		return false
+	}
+	if next, ok := ast.GetNextNode(node).(*ast.Text); ok && len(next.Literal) > 0 && isAlnum(next.Literal[0]) {
+		return false
+	}
+	if first, ok := ast.GetFirstChild(node).(*ast.Text); ok && bytes.HasPrefix(first.Literal, []byte("_")) {
+		return false
+	}
+	if last, ok := ast.GetLastChild(node).(*ast.Text); ok && bytes.HasSuffix(last.Literal, []byte("_")) {
+		return false
+	}
+	for p := node.GetParent(); p != nil; p = p.GetParent() {
+		switch p.(type) {
+		case *ast.Emph, *ast.Strong:
+			return !underscore(p)
+		}
+	}
+	return true
+}
+
+// codeSpan returns literal as a code span. The backtick fence is one longer than the longest run of
+// backticks in literal, if literal starts or ends with a backtick it is padded with a space.
+func codeSpan(literal []byte) []byte {
+	longest, run := 0, 0
+	for _, c := range literal {
+		if c != '`' {
+			run = 0
+			continue
+		}
+		run++
+		if run > longest {
+			longest = run
+		}
+	}
+	fence := bytes.Repeat([]byte("`"), longest+1)
+	pad := bytes.HasPrefix(literal, []byte("`")) || bytes.HasSuffix(literal, []byte("`"))
+
+	span := append([]byte{}, fence...)
+	if pad {
+		span = append(span, ' ')
+	}
+	span = append(span, literal...)
+	if pad {
+		span = append(span, ' ')
+	}
+	return append(span, fence...)
+}
+
+// dashes replaces --- with an em dash and -- with an en dash. Longer runs of dashes, dashes that are
+// part of an arrow (-->) and words that contain an URL are not changed.
+func dashes(data []byte) []byte {
+	ret := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		if isSpace(data[i]) {
+			ret = append(ret, data[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(data) && !isSpace(data[j]) {
+			j++
+		}
+		word := data[i:j]
+		if bytes.Contains(word, []byte("://")) {
+			ret = append(ret, word...)
+			i = j
+			continue
+		}
+		for k := 0; k < len(word); {
+			if word[k] != '-' {
+				ret = append(ret, word[k])
+				k++
+				continue
+			}
+			l := k
+			for l < len(word) && word[l] == '-' {
+				l++
+			}
+			arrow := k > 0 && word[k-1] == '<' || l < len(word) && word[l] == '>'
+			switch {
+			case arrow:
+				ret = append(ret, word[k:l]...)
+			case l-k == 3:
+				ret = append(ret, "\u2014"...)
+			case l-k == 2:
+				ret = append(ret, "\u2013"...)
+			default:
+				ret = append(ret, word[k:l]...)
+			}
+			k = l
+		}
+		i = j
+	}
+	return ret
+}
+
+// isPILine returns true if data, without surrounding whitespace, is a single processing instruction:
+// {:pi toc="yes"}.
+func isPILine(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return false
+	}
+	return bytes.HasPrefix(data, []byte("{:pi ")) && bytes.HasSuffix(data, []byte("}"))
+}
+
+// hasStrong returns true if node has a strong node as one of its children.
+func hasStrong(node ast.Node) bool {
+	for _, c := range node.GetChildren() {
+		if _, ok := c.(*ast.Strong); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// attributeBytes returns the attribute attr as {#id .class key="value"}. If CanonicalizeAttributes is set
+// the classes are sorted and duplicates are removed.
+func (r *Renderer) attributeBytes(attr *ast.Attribute) []byte {
+	if !r.opts.CanonicalizeAttributes || len(attr.Classes) < 2 {
+		return mast.AttributeBytes(attr)
+	}
+	classes := make([][]byte, len(attr.Classes))
+	copy(classes, attr.Classes)
+	sort.Slice(classes, func(i, j int) bool { return bytes.Compare(classes[i], classes[j]) < 0 })
+	uniq := classes[:1]
+	for _, c := range classes[1:] {
+		if !bytes.Equal(c, uniq[len(uniq)-1]) {
+			uniq = append(uniq, c)
+		}
+	}
+	canon := *attr
+	canon.Classes = uniq
+	return mast.AttributeBytes(&canon)
+}
+
+// startStack tracks the start positions of (nested) elements in the output buffer.
+type startStack struct {
+	s []int
+}
+
+// push pushes the current length of w, if w is a *bytes.Buffer, otherwise 0 is pushed.
+func (s *startStack) push(w io.Writer) {
+	start := 0
+	if buf, ok := w.(*bytes.Buffer); ok {
+		start = buf.Len()
+	}
+	s.s = append(s.s, start)
+}
+
+// pop returns the last pushed start position.
+func (s *startStack) pop() int {
+	if len(s.s) == 0 {
+		return 0
+	}
+	last := s.s[len(s.s)-1]
+	s.s = s.s[:len(s.s)-1]
+	return last
+}
+
 // listPrefixLength returns the length of the prefix we need for list in ast.Node
 func listPrefixLength(list *ast.List, start int) int {
 	numChild := len(list.Children) + start
@@ -138,3 +679,7 @@ func Space(length int) []byte { return bytes.Repeat([]byte(" "), length) }
 func isSpace(c byte) bool {
 	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
 }
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -20,3 +20,40 @@ func TestPrefixPush(t *testing.T) {
 		t.Errorf("Expected %s, got %s", "A", prefix.flatten())
 	}
 }
+
+func TestStartStack(t *testing.T) {
+	s := &startStack{}
+	buf := &bytes.Buffer{}
+	s.push(buf)
+	buf.WriteString("aside")
+	s.push(buf)
+
+	if x := s.pop(); x != 5 {
+		t.Errorf("Expected %d, got %d", 5, x)
+	}
+	if x := s.pop(); x != 0 {
+		t.Errorf("Expected %d, got %d", 0, x)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		in     string
+		width  int
+		prefix string
+		out    string
+	}{
+		{"one two three four", 10, "", "one two\nthree four"},
+		{"one two three four", 10, "> ", "> one two\n> three\n> four"},
+		{"one\ntwo", 80, "", "one two"},
+		{"averyveryverylongword short", 10, "", "averyveryverylongword\nshort"},
+		{"one two", 2, "> > ", "> > one\n> > two"},
+		{"one two", 4, "> > ", "> > one\n> > two"},
+	}
+	for i, test := range tests {
+		out := WrapText([]byte(test.in), test.width, []byte(test.prefix))
+		if string(out) != test.out {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, test.out, out)
+		}
+	}
+}
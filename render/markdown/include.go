@@ -1,6 +1,10 @@
 package markdown
 
-import "github.com/mmarkdown/mmark/mparser"
+import (
+	"bytes"
+
+	"github.com/mmarkdown/mmark/mparser"
+)
 
 // Almost wholesale copy of parser/include.go - might make sense to make some of that public.
 
@@ -47,3 +51,16 @@ func isCodeInclude(data []byte) int {
 	}
 	return x + 2
 }
+
+// isIncludeLine returns true if data, without surrounding whitespace, is a single (code) include.
+func isIncludeLine(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) < 3 || bytes.IndexByte(data, '\n') >= 0 {
+		return false
+	}
+	j := isInclude(data)
+	if j == 0 {
+		j = isCodeInclude(data)
+	}
+	return j > 0 && j >= len(data)-1
+}
@@ -2,12 +2,13 @@
 package markdown
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/gomarkdown/markdown/ast"
 	"github.com/gomarkdown/markdown/html"
@@ -24,6 +25,16 @@ const (
 	CommonFlags Flags = FlagsNone
 )
 
+// WrapMode controls how the text of paragraphs is wrapped.
+type WrapMode int
+
+const (
+	WrapFixed    WrapMode = iota // Wrap text at TextWidth
+	WrapNone                     // Don't wrap text, each paragraph is a single line
+	WrapSentence                 // Put each sentence on its own line
+	WrapPreserve                 // Keep the line breaks of the source, i.e. preserve soft breaks
+)
+
 // RendererOptions is a collection of supplementary parameters tweaking
 // the behavior of various parts of Markdown renderer.
 type RendererOptions struct {
@@ -31,34 +42,130 @@ type RendererOptions struct {
 
 	TextWidth int
 
+	// WrapMode sets how paragraphs are wrapped, the default is WrapFixed.
+	WrapMode WrapMode
+	// MaxWidth is the maximum width of the document. If set, it caps TextWidth and shrinks tables that
+	// are wider. A table that is still wider, because its cells can't be wrapped, and code block info
+	// lines that are longer are returned as errors by Err.
+	MaxWidth int
+	// MaxTableColWidth caps the width of table columns. Cells in a pipe table can't span multiple lines,
+	// so a cell that is wider than its column is not wrapped, it is output as-is without padding.
+	MaxTableColWidth int
+	// TitleQuote is the quote used for link and image titles, either '"' (the default) or '\''.
+	TitleQuote byte
+	// BulletMarker is the marker used for all unordered list items, either '*', '-' or '+'. If not set the
+	// markers alternate between '*' and '-' for each nesting level. Any other marker is returned as an
+	// error by Err and the default is used.
+	BulletMarker byte
+	// BlankBeforeList makes sure there is always an empty line before a list, this includes a list
+	// nested in a tight list. Such an empty line makes the outer list a loose list, so it is output as one.
+	// A list can't interrupt a paragraph, so it is never directly preceded by one.
+	BlankBeforeList bool
+	// CompactTables outputs tables without padding: the cells aren't aligned and the separators are
+	// as short as possible (---).
+	CompactTables bool
+	// QuotePrefix and AsidePrefix are the prefixes used for quotes and asides, they default to Quote
+	// and Aside. The only other valid prefixes are ">" and "A>", without the space. Any other prefix is
+	// returned as an error by Err and the default is used.
+	QuotePrefix string
+	AsidePrefix string
+	// ValidateCategory checks the status of the seriesInfo in the title block, which is the RFC's
+	// category, against the known values. An unknown value is returned as an error by Err.
+	ValidateCategory bool
+
+	// AlwaysEmitHeadingID outputs the ID of a heading, even when it is equal to the one that would
+	// be generated from the heading's text. Generated IDs are made unique with a numbered suffix.
+	AlwaysEmitHeadingID bool
+
+	// HeadingAlign, if set, aligns the text of ATX headings on this column, by padding the hashes
+	// with spaces, i.e. with 5: "#    Heading" and "###  Heading".
+	HeadingAlign int
+
+	// CitationLocators translates the locator label in a citation's suffix, i.e. with "Section" mapped
+	// to "Abschnitt", [@RFC2119, Section 2] is rendered as [@RFC2119, Abschnitt 2].
+	CitationLocators map[string]string
+
+	// UnSmartypants replaces typographic (curly) quotes, em and en dashes and ellipsis in text with
+	// their ASCII equivalents: ", ', ---, -- and ...
+	UnSmartypants bool
+	// NormalizeTypography replaces --- with an em dash and -- with an en dash in text. Code and URLs are
+	// left alone. UnSmartypants takes precedence.
+	NormalizeTypography bool
+
+	// CommonMarkStrict disables mmark specific syntax to output portable CommonMark: asides become
+	// quotes, citations and cross references become links, and title blocks, indices, document
+	// matters, heading IDs, special headings and attributes are dropped. Captions become paragraphs,
+	// definitions become bullet list items, math becomes code and sub- and superscripts become HTML.
+	CommonMarkStrict bool
+
+	// CanonicalizeAttributes sorts and deduplicates the classes in attributes. The ID always comes first
+	// and key=value pairs are always sorted.
+	CanonicalizeAttributes bool
+
+	// CodeIndent indents the fences of top-level code blocks with this many spaces, at most 3 as
+	// more would make it an indented code block. The parser keeps the indentation of the code itself,
+	// so that is left alone.
+	CodeIndent int
+
+	// SetextHeadings outputs level 1 and 2 headings as setext headings, underlined with = and -.
+	SetextHeadings bool
+	// ClosingHeadingHashes closes ATX headings with hashes, i.e. ## Heading ##.
+	ClosingHeadingHashes bool
+	// LowerCaseCitations and UpperCaseCitations lower or upper case all citation keys.
+	LowerCaseCitations bool
+	UpperCaseCitations bool
+	// CodeInfoAttribute outputs the language of a code block as an attribute: ~~~ {.go}.
+	CodeInfoAttribute bool
+	// PreserveFenceLength uses the fence recorded in the AST instead of ~~~. The parser doesn't record
+	// the fence, so this only has an effect on an AST that sets it.
+	PreserveFenceLength bool
+	// MinimalEmphasis uses _ for emphasis when that is unambiguous, * otherwise.
+	MinimalEmphasis bool
+	// EmptyPrefixLines outputs the empty lines in quotes and asides without the prefix.
+	EmptyPrefixLines bool
+	// CompactCitations doesn't put a space after the separators in a citation: [@a;@b,p. 2].
+	CompactCitations bool
+	// LazyListNumbers numbers all ordered list items with the list's start number: 1. 1. 1.
+	LazyListNumbers bool
+
 	// if set, called at the start of RenderNode(). Allows replacing rendering of some nodes
 	RenderNodeHook html.RenderNodeFunc
+	// if set, called before a table is rendered with the width of each column, including the space
+	// that pads the cell. The widths may be changed.
+	TableHook func(tab *ast.Table, widths []int)
 }
 
 // Renderer implements Renderer interface for Markdown output.
 type Renderer struct {
 	opts RendererOptions
 
-	// TODO(miek): paraStart should probably be a stack, aside in para in aside, etc.
-	paraStart    int
-	headingStart int
+	buf *bytes.Buffer // output buffer used when we're not writing to a *bytes.Buffer, flushed in RenderFooter
+
+	paraStart    *startStack // start of paragraphs in the buffer, used for reflowing
+	headingStart *startStack // start of headings in the buffer
 
 	prefix *prefixStack // track current prefix, quote, aside, etc.
 
 	// tables
-	cellStart int
-	col       int
-	colWidth  []int
-	colAlign  []ast.CellAlignFlags
-	tableType ast.Node
+	tableStart int
+	cellStart  int
+	col        int
+	colWidth   []int
+	colAlign   []ast.CellAlignFlags
+	tableType  ast.Node
 
 	suppress bool // when true we suppress newlines
 
+	errs []error // errors encountered while rendering, see Err
+
+	verbatim [][2]int // start and end of output that must be kept as is (code, math and HTML blocks, empty definitions), these lines are not trimmed
+
 	deferredFootBuf *bytes.Buffer // deferred footnote buffer. Appended to the doc at the end.
 	deferredFootID  map[string]struct{}
 
 	deferredLinkBuf *bytes.Buffer // deferred footnote buffer. Appended to the doc at the end.
 	deferredLinkID  map[string]struct{}
+	headingID       map[string]bool // heading IDs in use, see uniqueHeadingID
 
 	listLevel int
 }
@@ -68,14 +175,52 @@ func NewRenderer(opts RendererOptions) *Renderer {
 	if opts.TextWidth == 0 {
 		opts.TextWidth = 80
 	}
+	if opts.TitleQuote != '\'' {
+		opts.TitleQuote = '"'
+	}
+	var errs []error
+	switch opts.BulletMarker {
+	case 0, '*', '-', '+':
+	default:
+		errs = append(errs, fmt.Errorf("bullet marker %q is not valid, using the default", opts.BulletMarker))
+		opts.BulletMarker = 0
+	}
+	var err error
+	if opts.QuotePrefix, err = prefixOrDefault(opts.QuotePrefix, Quote); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.AsidePrefix, err = prefixOrDefault(opts.AsidePrefix, Aside); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.CodeIndent > 3 {
+		opts.CodeIndent = 3
+	}
+	if opts.MaxWidth > 0 && opts.TextWidth > opts.MaxWidth {
+		opts.TextWidth = opts.MaxWidth
+	}
 	return &Renderer{
 		opts:            opts,
+		errs:            errs,
+		buf:             &bytes.Buffer{},
 		prefix:          &prefixStack{p: [][]byte{}},
+		paraStart:       &startStack{},
+		headingStart:    &startStack{},
 		deferredFootBuf: &bytes.Buffer{},
 		deferredFootID:  make(map[string]struct{}),
 		deferredLinkBuf: &bytes.Buffer{},
 		deferredLinkID:  make(map[string]struct{}),
+		headingID:       make(map[string]bool),
+	}
+}
+
+// softBreak outputs a soft break as a space, so the paragraph can be reflowed. With WrapPreserve the
+// break is kept as a newline.
+func (r *Renderer) softBreak(w io.Writer, node *ast.Softbreak) {
+	if r.opts.WrapMode == WrapPreserve {
+		r.outs(w, "\n")
+		return
 	}
+	r.outs(w, " ")
 }
 
 func (r *Renderer) hardBreak(w io.Writer, node *ast.Hardbreak) {
@@ -84,62 +229,206 @@ func (r *Renderer) hardBreak(w io.Writer, node *ast.Hardbreak) {
 }
 
 func (r *Renderer) matter(w io.Writer, node *ast.DocumentMatter, entering bool) {
-	if !entering {
+	if !entering || r.opts.CommonMarkStrict {
 		return
 	}
 	switch node.Matter {
 	case ast.DocumentMatterFront:
-		r.outs(w, "{frontmatter}\n\n")
+		r.outs(w, "{frontmatter}")
 	case ast.DocumentMatterMain:
-		r.outs(w, "{mainmatter}\n\n")
+		r.outs(w, "{mainmatter}")
 	case ast.DocumentMatterBack:
-		r.outs(w, "{backmatter}\n\n")
+		r.outs(w, "{backmatter}")
+	}
+	r.endline(w)
+	r.blockEnd(w, node)
+}
+
+// uniqueHeadingID returns id, or when id is already in use, id with the first free numbered suffix: id-1,
+// id-2, etc.
+func (r *Renderer) uniqueHeadingID(id string) string {
+	unique := id
+	for n := 1; r.headingID[unique]; n++ {
+		unique = id + "-" + strconv.Itoa(n)
 	}
+	r.headingID[unique] = true
+	return unique
+}
+
+// explicitHeadingIDs registers the explicit heading IDs in doc, so a generated ID doesn't clash with
+// one that is set later in the document. An ID is explicit if it isn't the one generated from the
+// heading's text.
+func (r *Renderer) explicitHeadingIDs(doc ast.Node) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		h, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.GoToNext
+		}
+		text := &bytes.Buffer{}
+		ast.WalkFunc(h, func(node ast.Node, entering bool) ast.WalkStatus {
+			if leaf := node.AsLeaf(); leaf != nil && entering {
+				text.Write(leaf.Literal)
+			}
+			return ast.GoToNext
+		})
+		if h.HeadingID != "" && sanitizeAnchorName(text.String()) != h.HeadingID {
+			r.headingID[h.HeadingID] = true
+		}
+		return ast.SkipChildren
+	})
 }
 
 func (r *Renderer) heading(w io.Writer, node *ast.Heading, entering bool) {
 	if !entering {
-		if node.HeadingID != "" {
-			var content string
-			if buf, ok := w.(*bytes.Buffer); ok {
-				content = buf.String()[r.headingStart:buf.Len()]
+		start := r.headingStart.pop()
+		var content string
+		if buf, ok := w.(*bytes.Buffer); ok {
+			r.headingSpace(buf, node, start)
+			content = buf.String()[start+r.headingMarker(node):]
+		}
+		// only print the ID if the sanitized string is not equal to the autogenerated HeadingID.
+		auto := sanitizeAnchorName(content) == node.HeadingID
+		id := node.HeadingID != "" && (r.opts.AlwaysEmitHeadingID || !auto)
+		id = id && !r.opts.CommonMarkStrict
+		headingID := node.HeadingID
+		if id && auto {
+			headingID = r.uniqueHeadingID(headingID)
+		}
+		if !r.setext(node) {
+			if r.opts.ClosingHeadingHashes {
+				// closing hashes must come before the ID, otherwise they are not parsed as such.
+				r.outs(w, " ")
+				r.outs(w, strings.Repeat("#", node.Level))
 			}
-			// skip node level and one space and only print if the sanitized string
-			// is not equal to the autogenerated HeadingID.
-			if sanitizeAnchorName(content[node.Level+1:]) != node.HeadingID {
-				r.outs(w, " {#"+node.HeadingID+"}")
+			if id {
+				r.outs(w, " {#"+headingID+"}")
 			}
+			r.endline(w)
+			r.blockEnd(w, node)
+			return
+		}
+
+		// A setext heading can't carry an ID suffix, put it in the block attribute in front of the heading,
+		// together with the attribute the heading already has.
+		attr := ast.Attribute{}
+		if a := mast.AttributeFromNode(node); a != nil && !r.opts.CommonMarkStrict {
+			attr = *a
+		}
+		if id {
+			attr.ID = []byte(headingID)
+		}
+		if buf, ok := w.(*bytes.Buffer); ok && (len(attr.ID) > 0 || len(attr.Classes) > 0 || len(attr.Attrs) > 0) {
+			line := append(r.attributeBytes(&attr), '\n')
+			line = append(line, r.prefix.flatten()...)
+			text := append(line, buf.Bytes()[start:]...)
+			buf.Truncate(start)
+			buf.Write(text)
+		}
+		underline := "="
+		if node.Level == 2 {
+			underline = "-"
 		}
+		width := utf8.RuneCountInString(content)
+		if width < 3 {
+			width = 3
+		}
+		r.endline(w)
+		r.outPrefix(w)
+		r.outs(w, strings.Repeat(underline, width))
 		r.endline(w)
-		r.newline(w)
+		r.blockEnd(w, node)
 		return
 	}
 
 	r.outPrefix(w)
 
-	if buf, ok := w.(*bytes.Buffer); ok {
-		r.headingStart = buf.Len()
+	r.headingStart.push(w)
+	if r.setext(node) {
+		return
 	}
-	if node.IsSpecial {
+	if r.special(node) {
 		r.outs(w, ".")
 	}
 	hashes := strings.Repeat("#", node.Level)
 	r.outs(w, hashes)
-	r.outs(w, " ")
+	r.out(w, Space(r.headingMarker(node)-r.headingHashes(node)))
+}
+
+// setext returns true if node should be rendered as a setext heading.
+func (r *Renderer) setext(node *ast.Heading) bool {
+	return r.opts.SetextHeadings && node.Level <= 2 && !node.IsSpecial
+}
+
+// headingMarker returns the length of the marker that starts the heading, i.e. the hashes and a
+// space, or more spaces if HeadingAlign is set.
+func (r *Renderer) headingMarker(node *ast.Heading) int {
+	if r.setext(node) {
+		return 0
+	}
+	hashes := r.headingHashes(node)
+	if r.opts.HeadingAlign > hashes+1 {
+		return r.opts.HeadingAlign
+	}
+	return hashes + 1
+}
+
+// headingHashes returns the number of hashes of the heading, this includes the dot for special
+// headings.
+func (r *Renderer) headingHashes(node *ast.Heading) int {
+	if r.special(node) {
+		return node.Level + 1
+	}
+	return node.Level
+}
+
+// special returns true if node is a special heading and should be output as such.
+func (r *Renderer) special(node *ast.Heading) bool { return node.IsSpecial && !r.opts.CommonMarkStrict }
+
+// headingSpace makes sure exactly one space (or the spaces for HeadingAlign) separates the hashes
+// from the heading text, any whitespace the heading text started with is removed. The heading starts at start in buf.
+func (r *Renderer) headingSpace(buf *bytes.Buffer, node *ast.Heading, start int) {
+	marker := start + r.headingMarker(node)
+	if marker > buf.Len() {
+		return
+	}
+	text := buf.Bytes()[marker:]
+	trimmed := bytes.TrimLeft(text, " \t")
+	if len(trimmed) == len(text) {
+		return
+	}
+	trimmed = append([]byte{}, trimmed...)
+	buf.Truncate(marker)
+	buf.Write(trimmed)
 }
 
 func (r *Renderer) horizontalRule(w io.Writer, node *ast.HorizontalRule) {
-	r.newline(w)
-	r.outs(w, "******")
-	r.newline(w)
+	r.outPrefix(w)
+	r.outs(w, "********")
+	r.endline(w)
+	r.blockEnd(w, node)
 }
 
 func (r *Renderer) citation(w io.Writer, node *ast.Citation, entering bool) {
-	r.outs(w, "[@")
+	if r.opts.CommonMarkStrict {
+		r.citationLinks(w, node)
+		return
+	}
+	// A trailing separator, or an empty reference, is never output, as the parser can't handle either.
+	sep, suffix := "; ", ", "
+	if r.opts.CompactCitations {
+		sep, suffix = ";", ","
+	}
+	r.outs(w, "[")
+	n := 0
 	for i, dest := range node.Destination {
-		if i > 0 {
-			r.outs(w, ", ")
+		if len(dest) == 0 {
+			continue
+		}
+		if n > 0 {
+			r.outs(w, sep)
 		}
+		n++
+		r.outs(w, "@")
 		switch node.Type[i] {
 		case ast.CitationTypeInformative:
 			// skip outputting ? as it's the default
@@ -148,27 +437,67 @@ func (r *Renderer) citation(w io.Writer, node *ast.Citation, entering bool) {
 		case ast.CitationTypeSuppressed:
 			r.outs(w, "-")
 		}
+		switch {
+		case r.opts.LowerCaseCitations:
+			dest = bytes.ToLower(dest)
+		case r.opts.UpperCaseCitations:
+			dest = bytes.ToUpper(dest)
+		}
 		r.out(w, dest)
-
+		if i < len(node.Suffix) && len(node.Suffix[i]) > 0 {
+			r.outs(w, suffix)
+			r.out(w, r.locator(node.Suffix[i]))
+		}
 	}
 	r.outs(w, "]")
 }
 
+// citationLinks renders each citation in node as a link to the reference: [RFC2119, Section 2](#RFC2119).
+func (r *Renderer) citationLinks(w io.Writer, node *ast.Citation) {
+	for i, dest := range node.Destination {
+		if i > 0 {
+			r.outs(w, "; ")
+		}
+		r.outs(w, "[")
+		r.out(w, dest)
+		if i < len(node.Suffix) && len(node.Suffix[i]) > 0 {
+			r.outs(w, ", ")
+			r.out(w, r.locator(node.Suffix[i]))
+		}
+		r.outs(w, "](#")
+		r.out(w, dest)
+		r.outs(w, ")")
+	}
+}
+
+// locator returns the citation suffix with its locator label, i.e. the first word, translated
+// with CitationLocators.
+func (r *Renderer) locator(suffix []byte) []byte {
+	label, rest := suffix, []byte{}
+	if i := bytes.IndexByte(suffix, ' '); i > 0 {
+		label, rest = suffix[:i], suffix[i:]
+	}
+	l, ok := r.opts.CitationLocators[string(label)]
+	if !ok {
+		return suffix
+	}
+	return append([]byte(l), rest...)
+}
+
 func (r *Renderer) paragraph(w io.Writer, para *ast.Paragraph, entering bool) {
 	if entering {
-		if buf, ok := w.(*bytes.Buffer); ok {
-			r.paraStart = buf.Len()
-		}
+		r.paraStart.push(w)
 		return
 	}
 
+	start := r.paraStart.pop()
 	buf, ok := w.(*bytes.Buffer)
 	end := 0
 	if ok {
 		end = buf.Len()
 	}
 	// Reformat the entire buffer and rewrite to the writer.
-	b := buf.Bytes()[r.paraStart:end]
+	b := buf.Bytes()[start:end]
 	// Ugly hack to re-detect code includes and a potential caption that should be put on a new line.
 	if newlines := bytes.Count(b, []byte("\n")); newlines == 1 { // cheap check first for one line paragraph.
 		if j := isCodeInclude(b); j > 0 {
@@ -182,22 +511,27 @@ func (r *Renderer) paragraph(w io.Writer, para *ast.Paragraph, entering bool) {
 
 	var indented []byte
 	// Scan for hardbreaks, if found, split the text up into multiple pieces, wrap each and put them
-	// back together with a newline in between.
+	// back together with a newline in between. Each piece, even an empty one, needs the prefix, so
+	// that the lines after the hardbreak stay in the list item, quote, etc.
 	p := bytes.Split(b, []byte("\\\n"))
 	for i := range p {
-		if len(indented) > 0 {
-			p1 := r.wrapText(p[i], r.prefix.flatten())
+		var p1 []byte
+		if isIncludeLine(p[i]) || isPILine(p[i]) {
+			// an include's address may contain spaces, it must not be wrapped, the same holds for a PI.
+			p1 = r.indentText(bytes.TrimSpace(p[i]), r.prefix.flatten())
+		} else {
+			p1 = r.wrapText(p[i], r.prefix.flatten())
+		}
+		if len(p1) == 0 {
+			p1 = r.prefix.flatten()
+		}
+		if i > 0 {
 			indented = append(indented, []byte("\\\n")...)
-			indented = append(indented, p1...)
-			continue
 		}
-		indented = r.wrapText(p[i], r.prefix.flatten())
-	}
-	if len(indented) == 0 {
-		indented = make([]byte, r.prefix.peek())
+		indented = append(indented, p1...)
 	}
 
-	buf.Truncate(r.paraStart)
+	buf.Truncate(start)
 
 	// Now an indented list didn't get is marker yet, override the initial spaces that have been
 	// created with the list marker, taking the current prefix into account.
@@ -215,21 +549,24 @@ func (r *Renderer) paragraph(w io.Writer, para *ast.Paragraph, entering bool) {
 			indented[plen+len(pos)] = '.'
 			indented[plen+len(pos)+1] = ' '
 
-			list.Start++
+			if !r.opts.LazyListNumbers {
+				list.Start++
+			}
 		case x&ast.ListTypeTerm != 0:
 			indented = append(indented[:plen], indented[plen+4:]...) // remove prefix.
-		case x&ast.ListTypeDefinition != 0:
+		case x&ast.ListTypeDefinition != 0 && !r.opts.CommonMarkStrict:
 			indented[plen+0] = ':'
 			indented[plen+1] = ' '
 			indented[plen+2] = ' '
+			if len(bytes.TrimSpace(indented[plen:])) == 1 {
+				// an empty definition is only recognized as such if it has a space after the colon, keep it.
+				indented = indented[:plen+2]
+				r.verbatim = append(r.verbatim, [2]int{buf.Len(), buf.Len() + 1})
+			}
 		default:
+			// with CommonMarkStrict a definition is output as a bullet list item.
 			indented[plen+0] = ' '
-			if r.listLevel%2 == 0 {
-				indented[plen+1] = '*'
-			} else {
-				indented[plen+1] = '-'
-			}
-
+			indented[plen+1] = r.bulletMarker()
 			indented[plen+2] = ' '
 		}
 	}
@@ -241,13 +578,15 @@ func (r *Renderer) paragraph(w io.Writer, para *ast.Paragraph, entering bool) {
 	if _, inCaption := para.Parent.(*ast.CaptionFigure); inCaption {
 		return
 	}
-	if !lastNode(para) {
-		r.newline(w)
-	}
+	r.blockEnd(w, para)
 }
 
 func (r *Renderer) list(w io.Writer, list *ast.List, entering bool) {
 	if entering {
+		if list.Tight && r.blankInItem(list) {
+			// the empty line before the nested list makes this a loose list when parsed again.
+			list.Tight = false
+		}
 		parent, isNested := list.Parent.(*ast.ListItem)
 		if isNested && parent.ListFlags&ast.ListTypeOrdered == 0 && parent.ListFlags&ast.ListTypeTerm == 0 && parent.ListFlags&ast.ListTypeDefinition == 0 {
 			r.listLevel++
@@ -268,36 +607,124 @@ func (r *Renderer) list(w io.Writer, list *ast.List, entering bool) {
 	if isNested && parent.ListFlags&ast.ListTypeOrdered == 0 && parent.ListFlags&ast.ListTypeTerm == 0 && parent.ListFlags&ast.ListTypeDefinition == 0 {
 		r.listLevel--
 	}
+	r.blockEnd(w, list)
+}
+
+func (r *Renderer) listItem(w io.Writer, item *ast.ListItem, entering bool) {
+	if !entering {
+		r.blockEnd(w, item)
+		return
+	}
+	// An empty definition doesn't have a paragraph that outputs the marker, do it here.
+	if item.ListFlags&ast.ListTypeDefinition != 0 && item.ListFlags&ast.ListTypeTerm == 0 && len(item.Children) == 0 {
+		prefix := r.prefix.flatten()
+		if r.opts.CommonMarkStrict {
+			r.out(w, prefix[:len(prefix)-r.prefix.peek()])
+			r.out(w, []byte{' ', r.bulletMarker()})
+			r.endline(w)
+			return
+		}
+		// an empty definition is only recognized as such if it has a space after the colon, keep it.
+		if buf, ok := w.(*bytes.Buffer); ok {
+			r.verbatim = append(r.verbatim, [2]int{buf.Len(), buf.Len() + 1})
+		}
+		r.out(w, prefix[:len(prefix)-r.prefix.peek()])
+		r.outs(w, ": ")
+		r.endline(w)
+	}
+}
+
+// bulletMarker returns the marker for an item in a bullet list, by default this alternates between '*'
+// and '-' for each nesting level.
+func (r *Renderer) bulletMarker() byte {
+	switch {
+	case r.opts.BulletMarker != 0:
+		return r.opts.BulletMarker
+	case r.listLevel%2 == 0:
+		return '*'
+	}
+	return '-'
 }
 
 func (r *Renderer) codeBlock(w io.Writer, codeBlock *ast.CodeBlock, entering bool) {
-	r.outPrefix(w)
-	r.outs(w, "~~~")
+	fence := r.codeFence(codeBlock)
+	if r.prefix.len() == 0 {
+		fence = append(Space(r.opts.CodeIndent), fence...)
+	}
+	line := append(r.prefix.flatten(), fence...)
 	if codeBlock.Info != nil {
-		r.outs(w, " ")
-		r.out(w, codeBlock.Info)
+		line = append(line, ' ')
+		line = append(line, r.codeInfo(codeBlock.Info)...)
+		if width := utf8.RuneCount(line); r.opts.MaxWidth > 0 && width > r.opts.MaxWidth {
+			r.errs = append(r.errs, fmt.Errorf("code block info %q is wider (%d) than the maximum width: %d", codeBlock.Info, width, r.opts.MaxWidth))
+		}
 	}
-
+	r.out(w, line)
 	r.endline(w)
 	indented := r.indentText(codeBlock.Literal, r.prefix.flatten())
+	if buf, ok := w.(*bytes.Buffer); ok {
+		r.verbatim = append(r.verbatim, [2]int{buf.Len(), buf.Len() + len(indented)})
+	}
 	r.out(w, indented)
 	r.outPrefix(w)
-	r.outs(w, "~~~\n")
+	r.out(w, fence)
+	r.endline(w)
+
+	r.blockEnd(w, codeBlock)
+}
+
+// codeFence returns the fence for codeBlock. This is ~~~, unless PreserveFenceLength is set and the
+// fence character and length are recorded in the AST. The parser doesn't record these, so the option only
+// has an effect on an AST that is built, or amended, by hand.
+func (r *Renderer) codeFence(codeBlock *ast.CodeBlock) []byte {
+	if !r.opts.PreserveFenceLength || codeBlock.FenceLength < 3 {
+		return []byte("~~~")
+	}
+	if c := codeBlock.FenceChar; c == '~' || c == '`' {
+		return bytes.Repeat([]byte{c}, codeBlock.FenceLength)
+	}
+	return bytes.Repeat([]byte("~"), codeBlock.FenceLength)
+}
 
-	if _, ok := ast.GetNextNode(codeBlock).(*ast.Caption); !ok {
-		r.newline(w)
+// codeInfo returns the info string of a code block. The parser only reads an info string of multiple
+// words, i.e. ".go .numberLines", when it is in braces, so such a string is always returned in braces. If
+// CodeInfoAttribute is set a single word is returned as an attribute as well, i.e. go becomes {.go}.
+func (r *Renderer) codeInfo(info []byte) []byte {
+	if len(info) == 0 {
+		return info
+	}
+	words := bytes.ContainsAny(info, " \t")
+	if !words && !r.opts.CodeInfoAttribute {
+		return info
+	}
+	attr := []byte("{")
+	if !words && info[0] != '.' {
+		attr = append(attr, '.')
 	}
-	return
+	attr = append(attr, info...)
+	return append(attr, '}')
 }
 
 func (r *Renderer) table(w io.Writer, tab *ast.Table, entering bool) {
 	if entering {
 		r.colWidth, r.colAlign = r.tableColWidth(tab)
+		r.tableMaxColWidth(r.colWidth)
+		r.tableMaxWidth(r.colWidth)
+		if r.opts.TableHook != nil {
+			r.opts.TableHook(tab, r.colWidth)
+		}
 		r.col = 0
-	} else {
-		r.colWidth = []int{}
-		r.colAlign = []ast.CellAlignFlags{}
+		if buf, ok := w.(*bytes.Buffer); ok {
+			r.tableStart = buf.Len()
+		}
+		return
+	}
+	if buf, ok := w.(*bytes.Buffer); ok {
+		r.tableWidthCheck(buf.Bytes()[r.tableStart:])
 	}
+	r.colWidth = []int{}
+	r.colAlign = []ast.CellAlignFlags{}
+	r.blockEnd(w, tab)
 }
 
 func (r *Renderer) tableRow(w io.Writer, tableRow *ast.TableRow, entering bool) {
@@ -306,7 +733,7 @@ func (r *Renderer) tableRow(w io.Writer, tableRow *ast.TableRow, entering bool)
 		r.col = 0
 		for i, width := range r.colWidth {
 			if _, isFooter := r.tableType.(*ast.TableFooter); isFooter {
-				r.out(w, bytes.Repeat([]byte("="), width+1))
+				r.out(w, bytes.Repeat([]byte("="), r.sepWidth(i, width)))
 
 				if i == len(r.colWidth)-1 {
 					r.endline(w)
@@ -320,18 +747,19 @@ func (r *Renderer) tableRow(w io.Writer, tableRow *ast.TableRow, entering bool)
 		return
 	}
 
+	r.tableRowPad(w)
 	for i, width := range r.colWidth {
 		if _, isHeader := r.tableType.(*ast.TableHeader); isHeader {
 			if i == 0 {
 				r.outPrefix(w)
 			}
-			heading := bytes.Repeat([]byte("-"), width+1)
+			heading := bytes.Repeat([]byte("-"), r.sepWidth(i, width))
 
 			switch r.colAlign[i] {
 			case ast.TableAlignmentLeft:
 				heading[0] = ':'
 			case ast.TableAlignmentRight:
-				heading[width] = ':'
+				heading[len(heading)-1] = ':'
 			}
 			r.out(w, heading)
 			if i == len(r.colWidth)-1 {
@@ -350,10 +778,11 @@ func (r *Renderer) tableCell(w io.Writer, tableCell *ast.TableCell, entering boo
 	}
 	if entering {
 		if buf, ok := w.(*bytes.Buffer); ok {
-			r.cellStart = buf.Len() + 1
+			r.cellStart = buf.Len()
 		}
-		if r.col > 0 {
+		if r.col > 0 && !r.opts.CompactTables {
 			r.out(w, Space(1))
+			r.cellStart++
 		}
 		return
 	}
@@ -362,10 +791,17 @@ func (r *Renderer) tableCell(w io.Writer, tableCell *ast.TableCell, entering boo
 	if buf, ok := w.(*bytes.Buffer); ok {
 		cur = buf.Len()
 	}
-	size := r.colWidth[r.col]
-	fill := bytes.Repeat(Space(1), size-(cur-r.cellStart))
-	r.out(w, fill)
-	if r.col == len(r.colWidth)-1 {
+	size := 0
+	if r.col < len(r.colWidth) {
+		size = r.colWidth[r.col]
+	}
+	if fill := size - (cur - r.cellStart); fill > 0 && !r.opts.CompactTables {
+		r.out(w, Space(fill))
+	}
+	if r.col >= len(r.colWidth)-1 {
+		if cur == r.cellStart {
+			r.tableRowClose(w)
+		}
 		r.endline(w)
 	} else {
 		r.outs(w, "|")
@@ -373,19 +809,45 @@ func (r *Renderer) tableCell(w io.Writer, tableCell *ast.TableCell, entering boo
 	r.col++
 }
 
-func (r *Renderer) htmlSpan(w io.Writer, span *ast.HTMLSpan) {}
+// htmlSpan outputs the span, this includes comments (<!-- ... -->), as-is.
+func (r *Renderer) htmlSpan(w io.Writer, span *ast.HTMLSpan) {
+	r.out(w, span.Literal)
+}
 
 func (r *Renderer) crossReference(w io.Writer, cr *ast.CrossReference, entering bool) {
-	if entering {
-		r.outs(w, "(#")
-		r.out(w, cr.Destination)
+	if r.opts.CommonMarkStrict {
+		if entering {
+			r.outs(w, "[")
+			r.out(w, cr.Destination)
+			r.outs(w, "](#")
+			r.out(w, cr.Destination)
+			r.outs(w, ")")
+		}
 		return
 	}
+	// A cross reference with children carries its own text, output it as a link to the destination.
+	if len(cr.GetChildren()) > 0 {
+		if entering {
+			r.outs(w, "[")
+			return
+		}
+		r.outs(w, "](#")
+		r.out(w, cr.Destination)
+	} else {
+		if entering {
+			r.outs(w, "(#")
+			r.out(w, cr.Destination)
+			return
+		}
+	}
 	r.outs(w, ")")
+	if attr := mast.AttributeFromNode(cr); attr != nil {
+		r.out(w, r.attributeBytes(attr))
+	}
 }
 
 func (r *Renderer) index(w io.Writer, index *ast.Index, entering bool) {
-	if !entering {
+	if !entering || r.opts.CommonMarkStrict {
 		return
 	}
 
@@ -406,9 +868,6 @@ func (r *Renderer) link(w io.Writer, link *ast.Link, entering bool) {
 	if !entering {
 		return
 	}
-	// clear link so we don't render any children.
-	defer func() { *link = ast.Link{} }()
-
 	// footnote
 	if link.NoteID > 0 {
 		ast.RemoveFromTree(link.Footnote)
@@ -425,7 +884,10 @@ func (r *Renderer) link(w io.Writer, link *ast.Link, entering bool) {
 			r.deferredFootBuf.Write([]byte("[^"))
 			r.deferredFootBuf.Write(link.DeferredID)
 			r.deferredFootBuf.Write([]byte("]: "))
-			r.deferredFootBuf.Write(link.Title)
+			// the lines after the first must be indented to stay part of the footnote.
+			title := r.indentText(bytes.TrimRight(link.Title, "\n"), Space(4))
+			r.deferredFootBuf.Write(bytes.TrimLeft(title, " "))
+			r.deferredFootBuf.Write([]byte("\n"))
 
 			r.deferredFootID[string(link.DeferredID)] = struct{}{}
 
@@ -437,6 +899,13 @@ func (r *Renderer) link(w io.Writer, link *ast.Link, entering bool) {
 		return
 	}
 
+	if auto := autolink(link); auto != nil {
+		r.outs(w, "<")
+		r.out(w, auto)
+		r.outs(w, ">")
+		return
+	}
+
 	// Render the text here, because we need it before the link.
 
 	r.outs(w, "[")
@@ -452,9 +921,8 @@ func (r *Renderer) link(w io.Writer, link *ast.Link, entering bool) {
 		r.outs(w, "(")
 		r.out(w, link.Destination)
 		if len(link.Title) > 0 {
-			r.outs(w, ` "`)
-			r.out(w, link.Title)
-			r.outs(w, `"`)
+			r.outs(w, " ")
+			r.out(w, r.title(link.Title))
 		}
 		r.outs(w, ")")
 		return
@@ -473,22 +941,25 @@ func (r *Renderer) link(w io.Writer, link *ast.Link, entering bool) {
 	io.WriteString(r.deferredLinkBuf, "]: ")
 	r.deferredLinkBuf.Write(link.Destination)
 	if len(link.Title) > 0 {
-		io.WriteString(r.deferredLinkBuf, ` "`)
-		r.deferredLinkBuf.Write(link.Title)
-		io.WriteString(r.deferredLinkBuf, `"`)
+		io.WriteString(r.deferredLinkBuf, " ")
+		r.deferredLinkBuf.Write(r.title(link.Title))
 	}
 	io.WriteString(r.deferredLinkBuf, "\n")
 
 	r.deferredLinkID[string(link.DeferredID)] = struct{}{}
 }
 
+// title returns the title quoted with TitleQuote, any unescaped quote in the title is escaped.
+func (r *Renderer) title(title []byte) []byte {
+	quote := r.opts.TitleQuote
+	quoted := append([]byte{quote}, escapeByte(title, quote)...)
+	return append(quoted, quote)
+}
+
 func (r *Renderer) image(w io.Writer, node *ast.Image, entering bool) {
 	if !entering {
 		return
 	}
-	// clear image so we don't render any children.
-	defer func() { *node = ast.Image{} }()
-
 	r.outs(w, "![")
 	for _, child := range node.GetChildren() {
 		ast.WalkFunc(child, func(node ast.Node, entering bool) ast.WalkStatus {
@@ -500,9 +971,8 @@ func (r *Renderer) image(w io.Writer, node *ast.Image, entering bool) {
 	r.outs(w, "(")
 	r.out(w, node.Destination)
 	if len(node.Title) > 0 {
-		r.outs(w, ` "`)
-		r.out(w, node.Title)
-		r.outs(w, `"`)
+		r.outs(w, " ")
+		r.out(w, r.title(node.Title))
 	}
 	r.outs(w, ")")
 }
@@ -511,32 +981,44 @@ func (r *Renderer) mathBlock(w io.Writer, mathBlock *ast.MathBlock, entering boo
 	if !entering {
 		return
 	}
+	// CommonMark has no math, output it as a code block.
+	start, end := "$$", "$$\n"
+	if r.opts.CommonMarkStrict {
+		start, end = "~~~ math", "~~~\n"
+	}
 	r.outPrefix(w)
-	r.outs(w, "$$")
+	r.outs(w, start)
 
 	math := r.indentText(mathBlock.Literal, r.prefix.flatten())
+	if buf, ok := w.(*bytes.Buffer); ok {
+		r.verbatim = append(r.verbatim, [2]int{buf.Len(), buf.Len() + len(math)})
+	}
 	r.out(w, math)
 
 	r.outPrefix(w)
-	r.outs(w, "$$\n")
+	r.outs(w, end)
 
-	if !lastNode(mathBlock) {
-		r.newline(w)
-	}
+	r.blockEnd(w, mathBlock)
 }
 
 func (r *Renderer) captionFigure(w io.Writer, figure *ast.CaptionFigure, entering bool) {
-	// if one of our children is an image this is an subfigure.
-	isImage := false
+	if !entering {
+		r.blockEnd(w, figure)
+		return
+	}
+	// if one of our children is an image or a math block this is an subfigure.
+	isFigure := false
 	ast.WalkFunc(figure, func(node ast.Node, entering bool) ast.WalkStatus {
-		_, isImage = node.(*ast.Image)
-		if isImage {
+		switch node.(type) {
+		case *ast.Image, *ast.MathBlock:
+			isFigure = true
 			return ast.Terminate
 		}
 		return ast.GoToNext
 
 	})
-	if isImage && entering {
+	if isFigure && !r.opts.CommonMarkStrict {
+		r.outPrefix(w)
 		r.outs(w, "!---")
 		r.endline(w)
 	}
@@ -544,7 +1026,15 @@ func (r *Renderer) captionFigure(w io.Writer, figure *ast.CaptionFigure, enterin
 
 func (r *Renderer) caption(w io.Writer, caption *ast.Caption, entering bool) {
 	if !entering {
-		r.newline(w)
+		// The caption's text may end in a newline (and spaces), remove it so the ID can be put on the same line.
+		if buf, ok := w.(*bytes.Buffer); ok {
+			buf.Truncate(len(bytes.TrimRight(buf.Bytes(), " \n")))
+		}
+		if figure, ok := caption.Parent.(*ast.CaptionFigure); ok && figure.HeadingID != "" && !r.opts.CommonMarkStrict {
+			r.outs(w, " {#"+figure.HeadingID+"}")
+		}
+		r.endline(w)
+		r.blockEnd(w, caption)
 		return
 	}
 
@@ -560,34 +1050,44 @@ func (r *Renderer) caption(w io.Writer, caption *ast.Caption, entering bool) {
 		r.outs(w, "Figure: ")
 		return
 	}
-	// If here, we're dealing with a subfigure captionFigure.
-	r.outs(w, "!---")
+	// If here, we're dealing with a subfigure captionFigure, holding images or a math block. With
+	// CommonMarkStrict the caption is a paragraph, an empty line keeps it out of the images' paragraph.
+	if !r.opts.CommonMarkStrict {
+		r.outs(w, "!---")
+	}
 	r.endline(w)
+	r.outPrefix(w)
 	r.outs(w, "Figure: ")
 }
 
 func (r *Renderer) blockQuote(w io.Writer, block *ast.BlockQuote, entering bool) {
 	if entering {
-		r.push(Quote)
+		r.push([]byte(r.opts.QuotePrefix))
 		return
 	}
 	r.pop()
-	r.newline(w)
+	r.blockEnd(w, block)
 }
 
 func (r *Renderer) aside(w io.Writer, block *ast.Aside, entering bool) {
 	if entering {
-		r.push(Aside)
+		if r.opts.CommonMarkStrict {
+			r.push([]byte(r.opts.QuotePrefix))
+			return
+		}
+		r.push([]byte(r.opts.AsidePrefix))
 		return
 	}
 	r.pop()
-	if !lastNode(block) {
-		r.newline(w)
-	}
+	r.blockEnd(w, block)
 }
 
 // RenderNode renders a markdown node to markdown.
 func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.WalkStatus {
+	// Reflowing needs access to what we've written, buffer the output if w isn't a buffer.
+	if _, ok := w.(*bytes.Buffer); !ok {
+		w = r.buf
+	}
 	if r.opts.RenderNodeHook != nil {
 		status, didHandle := r.opts.RenderNodeHook(w, node, entering)
 		if didHandle {
@@ -595,7 +1095,7 @@ func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.Wal
 		}
 	}
 
-	if attr := mast.AttributeFromNode(node); attr != nil && entering {
+	if attr := mast.AttributeFromNode(node); attr != nil && entering && !r.opts.CommonMarkStrict {
 		switch node.(type) {
 		case *ast.CaptionFigure:
 			// captionFigure also gets the attribute for a codeblock, don't output that.
@@ -606,28 +1106,42 @@ func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.Wal
 				case *ast.BlockQuote:
 				default:
 					r.outPrefix(w)
-					w.Write((mast.AttributeBytes(attr)))
+					w.Write(r.attributeBytes(attr))
 					r.endline(w)
 				}
 			}
 
+		case *ast.CrossReference:
+			// inline, the attribute is rendered after the node.
+		case *ast.Emph, *ast.Strong, *ast.Del, *ast.Code, *ast.Math, *ast.Subscript, *ast.Superscript, *ast.Link, *ast.Image:
+			// inline, the attribute is rendered after the span, see spanAttribute.
+
 		default:
+			if h, ok := node.(*ast.Heading); ok && r.setext(h) {
+				// a setext heading outputs the attribute itself, together with its ID.
+				break
+			}
 			r.outPrefix(w)
-			w.Write((mast.AttributeBytes(attr)))
+			w.Write(r.attributeBytes(attr))
 			r.endline(w)
 
 		}
 	}
 
+	status := ast.GoToNext
 	switch node := node.(type) {
 	case *ast.Document:
 		// do nothing
 	case *mast.Title:
+		if r.opts.CommonMarkStrict {
+			break
+		}
+		r.titleCheck(node)
 		r.outs(w, node.Trigger)
-		r.out(w, node.Content)
+		r.out(w, titleOrder(titleBools(node.Content)))
 		r.outs(w, node.Trigger)
-		r.outs(w, "\n")
-		r.newline(w)
+		r.endline(w)
+		r.blockEnd(w, node)
 	case *mast.Bibliography:
 	case *mast.BibliographyItem:
 	case *mast.DocumentIndex, *mast.IndexLetter, *mast.IndexItem, *mast.IndexSubItem, *mast.IndexLink:
@@ -636,14 +1150,15 @@ func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.Wal
 	case *ast.Text:
 		r.text(w, node, entering)
 	case *ast.Softbreak:
+		r.softBreak(w, node)
 	case *ast.Hardbreak:
 		r.hardBreak(w, node)
 	case *ast.Callout:
 		r.callout(w, node, entering)
 	case *ast.Emph:
-		r.outOneOf(w, entering, "*", "*")
+		r.outs(w, r.emphasis(node))
 	case *ast.Strong:
-		r.outOneOf(w, entering, "**", "**")
+		r.outs(w, r.emphasis(node))
 	case *ast.Del:
 		r.outOneOf(w, entering, "~~", "~~")
 	case *ast.Citation:
@@ -654,25 +1169,26 @@ func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.Wal
 		r.heading(w, node, entering)
 	case *ast.HorizontalRule:
 		if entering {
-			r.newline(w)
-			r.outPrefix(w)
-			r.outs(w, "********\n")
-			r.newline(w)
+			r.horizontalRule(w, node)
 		}
 	case *ast.Paragraph:
 		r.paragraph(w, node, entering)
 	case *ast.HTMLSpan:
-		r.out(w, node.Literal)
+		r.htmlSpan(w, node)
 	case *ast.HTMLBlock:
-		r.out(w, node.Literal)
+		// trailing newlines would add extra empty lines, blockEnd adds the empty line after the block.
+		html := bytes.TrimRight(node.Literal, "\n")
+		// as with code, the block is output verbatim, e.g. empty lines in a comment are kept.
+		if buf, ok := w.(*bytes.Buffer); ok {
+			r.verbatim = append(r.verbatim, [2]int{buf.Len(), buf.Len() + len(html)})
+		}
+		r.out(w, html)
 		r.endline(w)
-		r.newline(w)
+		r.blockEnd(w, node)
 	case *ast.List:
 		r.list(w, node, entering)
 	case *ast.ListItem:
-		if !entering {
-			r.newline(w)
-		}
+		r.listItem(w, node, entering)
 	case *ast.CodeBlock:
 		r.codeBlock(w, node, entering)
 	case *ast.Caption:
@@ -701,7 +1217,14 @@ func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.Wal
 		r.index(w, node, entering)
 	case *ast.Link:
 		r.link(w, node, entering)
+		// the children are rendered by link, don't walk them again.
+		status = ast.SkipChildren
 	case *ast.Math:
+		if r.opts.CommonMarkStrict {
+			// CommonMark has no math, output it as code.
+			r.out(w, codeSpan(node.Literal))
+			break
+		}
 		r.outOneOf(w, true, "$", "$")
 		if entering {
 			r.out(w, node.Literal)
@@ -709,28 +1232,72 @@ func (r *Renderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.Wal
 		r.outOneOf(w, false, "$", "$")
 	case *ast.Image:
 		r.image(w, node, entering)
+		status = ast.SkipChildren
 	case *ast.Code:
-		r.outs(w, "`")
-		r.out(w, node.Literal)
-		r.outs(w, "`")
+		r.out(w, codeSpan(node.Literal))
 	case *ast.MathBlock:
 		r.mathBlock(w, node, entering)
 	case *ast.Subscript:
+		if r.opts.CommonMarkStrict {
+			r.outs(w, "<sub>"+string(node.Literal)+"</sub>")
+			break
+		}
 		r.outOneOf(w, true, "~", "~")
 		if entering {
 			r.out(w, node.Literal)
 		}
 		r.outOneOf(w, false, "~", "~")
 	case *ast.Superscript:
+		if r.opts.CommonMarkStrict {
+			r.outs(w, "<sup>"+string(node.Literal)+"</sup>")
+			break
+		}
 		r.outOneOf(w, true, "^", "^")
 		if entering {
 			r.out(w, node.Literal)
 		}
 		r.outOneOf(w, false, "^", "^")
 	default:
-		panic(fmt.Sprintf("Unknown node %T", node))
+		// Don't panic, but record the error and render the children (if any) of the node.
+		if entering {
+			r.errs = append(r.errs, fmt.Errorf("unknown node %T", node))
+		}
+	}
+	r.spanAttribute(w, node, entering)
+	return status
+}
+
+// spanAttribute outputs the attribute of an inline span directly after the span: *text*{.class}.
+func (r *Renderer) spanAttribute(w io.Writer, node ast.Node, entering bool) {
+	if r.opts.CommonMarkStrict {
+		return
+	}
+	switch node.(type) {
+	case *ast.Emph, *ast.Strong, *ast.Del, *ast.Link, *ast.Image:
+		if entering {
+			return
+		}
+	case *ast.Code, *ast.Math, *ast.Subscript, *ast.Superscript:
+		// leaf nodes, these are only called when entering.
+	default:
+		return
+	}
+	if attr := mast.AttributeFromNode(node); attr != nil {
+		r.out(w, r.attributeBytes(attr))
 	}
-	return ast.GoToNext
+}
+
+// Err returns the errors encountered while rendering, and the invalid options NewRenderer replaced with their
+// default, or nil if there are none.
+func (r *Renderer) Err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+	msg := make([]string, len(r.errs))
+	for i := range r.errs {
+		msg[i] = r.errs[i].Error()
+	}
+	return errors.New(strings.Join(msg, "; "))
 }
 
 func (r *Renderer) callout(w io.Writer, node *ast.Callout, entering bool) {
@@ -760,37 +1327,83 @@ func (r *Renderer) text(w io.Writer, node *ast.Text, entering bool) {
 		}
 	}
 
+	if r.opts.UnSmartypants {
+		r.outs(w, unSmartypants.Replace(string(node.Literal)))
+		return
+	}
+	if r.opts.NormalizeTypography {
+		r.out(w, dashes(node.Literal))
+		return
+	}
 	r.out(w, node.Literal)
 }
 
-func (r *Renderer) RenderHeader(_ io.Writer, _ ast.Node) {}
-func (r *Renderer) writeDocumentHeader(_ io.Writer)      {}
+// unSmartypants replaces typographic quotes, dashes and ellipsis with their ASCII equivalents.
+var unSmartypants = strings.NewReplacer(
+	"\u201c", `"`, "\u201d", `"`, "\u201e", `"`,
+	"\u2018", "'", "\u2019", "'", "\u201a", "'",
+	"\u2014", "---", "\u2013", "--",
+	"\u2026", "...",
+)
+
+func (r *Renderer) RenderHeader(_ io.Writer, doc ast.Node) {
+	r.explicitHeadingIDs(doc)
+}
+
+func (r *Renderer) writeDocumentHeader(_ io.Writer) {}
 
 func (r *Renderer) RenderFooter(w io.Writer, _ ast.Node) {
+	// If w isn't a buffer, RenderNode has written to our own buffer, which we flush to w at the end.
+	buf, ok := w.(*bytes.Buffer)
+	if !ok {
+		buf = r.buf
+	}
+
 	if r.deferredFootBuf.Len() > 0 {
-		r.outs(w, "\n")
-		io.Copy(w, r.deferredFootBuf)
+		r.outs(buf, "\n")
+		io.Copy(buf, r.deferredFootBuf)
 	}
 	if r.deferredLinkBuf.Len() > 0 {
-		r.outs(w, "\n")
-		io.Copy(w, r.deferredLinkBuf)
-	}
-
-	buf, ok := w.(*bytes.Buffer)
-	if !ok {
-		return
+		r.outs(buf, "\n")
+		io.Copy(buf, r.deferredLinkBuf)
 	}
 
 	trimmed := &bytes.Buffer{}
 
-	scanner := bufio.NewScanner(buf)
-	for scanner.Scan() {
-		trimmed.Write(bytes.TrimRight(scanner.Bytes(), " "))
-		trimmed.WriteString("\n")
+	// Trailing spaces may be significant in code, so lines inside code blocks, and other verbatim output,
+	// are left alone. Outside of those, runs of empty lines, which may come from the literal content of
+	// nodes, are collapsed. The lines are split with bytes.Split, a bufio.Scanner fails on lines longer
+	// than its buffer.
+	pos, verbatim := 0, r.verbatim
+	empty := 0
+	lines := bytes.Split(buf.Bytes(), []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1] // the final newline doesn't start another line
 	}
-	if err := scanner.Err(); err != nil {
-		return
+	for _, line := range lines {
+		for len(verbatim) > 0 && pos >= verbatim[0][1] {
+			verbatim = verbatim[1:]
+		}
+		isVerbatim := len(verbatim) > 0 && pos >= verbatim[0][0]
+		pos += len(line) + 1
+
+		if isVerbatim {
+			empty = 0
+		} else {
+			line = bytes.TrimRight(line, " ")
+			if len(line) == 0 {
+				empty++
+				if empty > 1 {
+					continue
+				}
+			} else {
+				empty = 0
+			}
+		}
+		trimmed.Write(line)
+		trimmed.WriteString("\n")
 	}
+	r.verbatim = nil
 
 	buf.Truncate(0)
 	data := trimmed.Bytes()
@@ -799,9 +1412,53 @@ func (r *Renderer) RenderFooter(w io.Writer, _ ast.Node) {
 		ld--
 	}
 	buf.Write(data[:ld])
+
+	if !ok {
+		buf.WriteTo(w)
+	}
+}
+
+// RenderMatter renders only the front, main or back matter of doc to w. When doc has a title block
+// the document starts in the front matter, otherwise it starts without any matter. The {frontmatter},
+// {mainmatter} and {backmatter} markers themselves are not rendered. Each call starts with a fresh
+// renderer state.
+func (r *Renderer) RenderMatter(w io.Writer, doc ast.Node, matter ast.DocumentMatters) {
+	*r = *NewRenderer(r.opts)
+
+	r.RenderHeader(w, doc)
+	current := ast.DocumentMatterNone
+	for _, child := range doc.GetChildren() {
+		switch node := child.(type) {
+		case *mast.Title:
+			current = ast.DocumentMatterFront
+			continue
+		case *ast.DocumentMatter:
+			current = node.Matter
+			continue
+		}
+		if current != matter {
+			continue
+		}
+		ast.WalkFunc(child, func(node ast.Node, entering bool) ast.WalkStatus {
+			return r.RenderNode(w, node, entering)
+		})
+	}
+	r.RenderFooter(w, doc)
 }
 
 var (
 	Aside = []byte("A> ")
 	Quote = []byte("> ")
 )
+
+// prefixOrDefault returns prefix if it is def, with or without the trailing space. An empty prefix returns
+// def, any other prefix returns def and an error.
+func prefixOrDefault(prefix string, def []byte) (string, error) {
+	switch prefix {
+	case "":
+		return string(def), nil
+	case string(def), strings.TrimSuffix(string(def), " "):
+		return prefix, nil
+	}
+	return string(def), fmt.Errorf("prefix %q is not valid, using %q", prefix, def)
+}
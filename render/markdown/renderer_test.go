@@ -0,0 +1,1206 @@
+package markdown
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/mmarkdown/mmark/mast"
+	"github.com/mmarkdown/mmark/mparser"
+)
+
+type renderTest struct {
+	in   string
+	out  string
+	opts RendererOptions
+}
+
+func testRender(t *testing.T, tests []renderTest) {
+	t.Helper()
+	testRenderAST(t, tests, nil)
+}
+
+// testRenderAST is testRender, but if mutate isn't nil it is called with the parsed document before it is
+// rendered. This is used to test trees the parser doesn't create.
+func testRenderAST(t *testing.T, tests []renderTest, mutate func(doc ast.Node)) {
+	t.Helper()
+	for i, test := range tests {
+		p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+		p.Opts = parser.Options{ParserHook: mparser.TitleHook}
+
+		doc := markdown.Parse([]byte(test.in), p)
+		if mutate != nil {
+			mutate(doc)
+		}
+		out := markdown.Render(doc, NewRenderer(test.opts))
+		out = bytes.TrimRight(out, " \n")
+
+		if string(out) != test.out {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, test.out, out)
+		}
+	}
+}
+
+func TestSetextHeadings(t *testing.T) {
+	opts := RendererOptions{SetextHeadings: true}
+	tests := []renderTest{
+		{"# Heading 1\n", "Heading 1\n=========", opts},
+		{"## Heading 2\n", "Heading 2\n---------", opts},
+		{"## Heading 2 {#h2}\n", "{#h2}\nHeading 2\n---------", opts},
+		{"{.class}\n## Heading 2 {#h2}\n", "{#h2 .class}\nHeading 2\n---------", opts},
+		{"{#h2 .class}\nHeading 2\n---------\n", "{#h2 .class}\nHeading 2\n---------", opts},
+		{"{.class}\n## Heading 2\n", "{.class}\nHeading 2\n---------", opts},
+		{"> {.class}\n> ## Heading 2 {#h2}\n", "> {#h2 .class}\n> Heading 2\n> ---------", opts},
+		{"### Heading 3\n", "### Heading 3", opts},
+		{"## Heading 2\n", "## Heading 2", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestClosingHeadingHashes(t *testing.T) {
+	opts := RendererOptions{ClosingHeadingHashes: true}
+	tests := []renderTest{
+		{"# Heading 1\n", "# Heading 1 #", opts},
+		{"### Heading 3 ###\n", "### Heading 3 ###", opts},
+		{"## Heading 2 {#h2}\n", "## Heading 2 ## {#h2}", opts},
+		{"## Heading 2 {#heading-2}\n", "## Heading 2 ##", opts},
+		{".# Abstract\n", ".# Abstract #", opts},
+		{"## Heading 2 ##\n", "## Heading 2", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestMaxWidth(t *testing.T) {
+	in := `Name | Description
+-----|------------
+Bob | A rather long description of Bob
+Alice | Short
+`
+	tests := []renderTest{
+		{in, `Name  | Description
+------|----------------------------------
+Bob   | A rather long description of Bob
+Alice | Short`, RendererOptions{}},
+		{in, `Name  | Description
+------|-----------------------------
+Bob   | A rather long description of Bob
+Alice | Short`, RendererOptions{MaxWidth: 36}},
+	}
+	testRender(t, tests)
+
+	// the cells can't be wrapped, so the shrunk table is still wider than MaxWidth, this is an error.
+	for i, test := range []struct {
+		in   string
+		opts RendererOptions
+		err  bool
+	}{
+		{in, RendererOptions{}, false},
+		{in, RendererOptions{MaxWidth: 40}, false},
+		{in, RendererOptions{MaxWidth: 36}, true},
+		{"~~~ go\nx := 1\n~~~\n", RendererOptions{MaxWidth: 6}, false},
+		{"~~~ go\nx := 1\n~~~\n", RendererOptions{MaxWidth: 6, CodeIndent: 2}, true},
+		{"> ~~~ go\n> x := 1\n> ~~~\n", RendererOptions{MaxWidth: 6}, true},
+		{"~~~ go\nx := 1\n~~~\n", RendererOptions{MaxWidth: 8, CodeInfoAttribute: true}, true},
+	} {
+		p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+		r := NewRenderer(test.opts)
+		markdown.Render(markdown.Parse([]byte(test.in), p), r)
+		if err := r.Err(); (err != nil) != test.err {
+			t.Errorf("Test %d, expected error %t, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestEscapeLineStart(t *testing.T) {
+	opts := RendererOptions{TextWidth: 20}
+	tests := []renderTest{
+		{"Follow us on twitter #hashtag\n", "Follow us on twitter\n\\#hashtag", opts},
+		{"Some text that ends > with this\n", "Some text that ends\n\\> with this", opts},
+		{"Some text that ends - with this\n", "Some text that ends\n\\- with this", opts},
+		{"Some text that ends + with this\n", "Some text that ends\n\\+ with this", opts},
+		{"Some text that ends * with this\n", "Some text that ends\n\\* with this", opts},
+		{"Some text that ends 1. with this\n", "Some text that ends\n1\\. with this", opts},
+		{"Some text that ends 12) with this\n", "Some text that ends\n12\\) with this", opts},
+		{"Some text that ends A> with this\n", "Some text that ends\nA\\> with this", opts},
+		{"Some text that ends : with this\n", "Some text that ends\n\\: with this", opts},
+		{"Some text that ends ~~~ with this\n", "Some text that ends\n\\~~~ with this", opts},
+		{"Some text that ends ---\n", "Some text that ends\n\\---", opts},
+		{"Some text that ends ===\n", "Some text that ends\n\\===", opts},
+		{"Some text that ends --\n", "Some text that ends\n\\--", opts},
+		{"Some text that ends ```x``y``` here\n", "Some text that ends\n```x``y``` here", opts},
+		{"\\# not a heading\n", "\\# not a heading", opts},
+		{"Some text that ends 2018 with this\n", "Some text that ends\n2018 with this", opts},
+	}
+	testRender(t, tests)
+}
+
+func TestWrapCodeSpan(t *testing.T) {
+	opts := RendererOptions{TextWidth: 20}
+	tests := []renderTest{
+		{"`aaaaaaaaaaaaa # bbb`\n", "`aaaaaaaaaaaaa # bbb`", opts},
+		{"Some text `with a # code span` and more.\n", "Some text\n`with a # code span`\nand more.", opts},
+		{"Keep `two  spaces` in code.\n", "Keep `two  spaces`\nin code.", opts},
+		{"A ``code ` span`` here\n", "A ``code ` span``\nhere", opts},
+	}
+	testRender(t, tests)
+}
+
+func TestCitationCase(t *testing.T) {
+	in := "As said in [@RFC2119] and [@!Miek-Gieben].\n"
+	tests := []renderTest{
+		{in, "As said in [@RFC2119] and [@!Miek-Gieben].", RendererOptions{}},
+		{in, "As said in [@rfc2119] and [@!miek-gieben].", RendererOptions{LowerCaseCitations: true}},
+		{in, "As said in [@RFC2119] and [@!MIEK-GIEBEN].", RendererOptions{UpperCaseCitations: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestListHardBreak(t *testing.T) {
+	opts := RendererOptions{TextWidth: 20}
+	tests := []renderTest{
+		{"* a first line that wraps\\\n  second line\n", " *  a first line\n    that wraps\\\n    second line", opts},
+		{"1. one\\\n   two\\\n   three\n", "1.  one\\\n    two\\\n    three", opts},
+		{"- a\\\n  \\\n  b\n", " *  a\\\n    \\\n    b", opts},
+		{"> * quoted\\\n>   break\n", ">  *  quoted\\\n>     break", opts},
+	}
+	testRender(t, tests)
+}
+
+func TestNestedReflow(t *testing.T) {
+	opts := RendererOptions{TextWidth: 40}
+	in := `A> Aside paragraph that is long enough to wrap around when the text width is small enough.
+A>
+A> > A quote in the aside with a paragraph that also needs to wrap because it is very long.
+A>
+A> More aside text after the quote.
+`
+	out := `A> Aside paragraph that is long enough
+A> to wrap around when the text width is
+A> small enough.
+A>
+A> > A quote in the aside with a
+A> > paragraph that also needs to wrap
+A> > because it is very long.
+A>
+A> More aside text after the quote.`
+	testRender(t, []renderTest{{in, out, opts}})
+}
+
+func TestIndexSection(t *testing.T) {
+	in := `Some text about (!Miek) and (!!Gieben, Miek).
+
+{backmatter}
+
+# Index
+
+{{.index-section}}
+`
+	addIndex := func(doc ast.Node) { mparser.AddIndex(doc) }
+	testRenderAST(t, []renderTest{{in, in[:len(in)-1], RendererOptions{}}}, addIndex)
+}
+
+func TestCodeInfoAttribute(t *testing.T) {
+	opts := RendererOptions{CodeInfoAttribute: true}
+	tests := []renderTest{
+		{"~~~ go\nfmt.Println()\n~~~\n", "~~~ go\nfmt.Println()\n~~~", RendererOptions{}},
+		{"~~~ go\nfmt.Println()\n~~~\n", "~~~ {.go}\nfmt.Println()\n~~~", opts},
+		{"~~~ {.go}\nfmt.Println()\n~~~\n", "~~~ {.go}\nfmt.Println()\n~~~", opts},
+		{"~~~\nfmt.Println()\n~~~\n", "~~~\nfmt.Println()\n~~~", opts},
+		// an info string of multiple words keeps its braces, otherwise it is not parsed as such.
+		{"~~~ {.go .numberLines}\nfmt.Println()\n~~~\n", "~~~ {.go .numberLines}\nfmt.Println()\n~~~", opts},
+		{"~~~ {.go .numberLines}\nfmt.Println()\n~~~\n", "~~~ {.go .numberLines}\nfmt.Println()\n~~~", RendererOptions{}},
+		{"~~~ {go linenos}\nfmt.Println()\n~~~\n", "~~~ {go linenos}\nfmt.Println()\n~~~", opts},
+		{"~~~ {go linenos}\nfmt.Println()\n~~~\n", "~~~ {go linenos}\nfmt.Println()\n~~~", RendererOptions{}},
+	}
+	testRender(t, tests)
+
+	// format twice, the code block must survive.
+	for i, test := range tests {
+		p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+		out := markdown.Render(markdown.Parse([]byte(test.in), p), NewRenderer(test.opts))
+		p = parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+		doc := markdown.Parse(out, p)
+		code, ok := doc.GetChildren()[0].(*ast.CodeBlock)
+		if !ok {
+			t.Errorf("Test %d, expected a code block after formatting twice, got %T", i, doc.GetChildren()[0])
+			continue
+		}
+		if x := string(bytes.Trim(code.Literal, "\n")); x != "fmt.Println()" {
+			t.Errorf("Test %d, expected %q, got %q", i, "fmt.Println()", x)
+		}
+	}
+}
+
+func TestCrossReferenceAttribute(t *testing.T) {
+	expand := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if _, ok := node.(*ast.CrossReference); ok && entering {
+				mast.AttributeInit(node)
+				mast.AttributeFromNode(node).Classes = [][]byte{[]byte("expand")}
+			}
+			return ast.GoToNext
+		})
+	}
+	tests := []renderTest{
+		{"See (#sec:x) for details.\n", "See (#sec:x){.expand} for details.", RendererOptions{}},
+	}
+	testRenderAST(t, tests, expand)
+}
+
+func TestEmptyDefinition(t *testing.T) {
+	tests := []renderTest{
+		{"Term\n: \n\nOther\n: def\n", "Term\n\n: \n\nOther\n\n:   def", RendererOptions{}},
+		{"~~~ yaml\n:\n~~~\n", "~~~ yaml\n:\n~~~", RendererOptions{}},
+		{"> ~~~ yaml\n> :\n> ~~~\n", "> ~~~ yaml\n> :\n> ~~~", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestSpanAttribute(t *testing.T) {
+	attr := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if !entering {
+				return ast.GoToNext
+			}
+			switch node.(type) {
+			case *ast.Emph:
+				mast.AttributeInit(node)
+				mast.AttributeFromNode(node).Classes = [][]byte{[]byte("class")}
+			case *ast.Code:
+				mast.AttributeInit(node)
+				mast.AttributeFromNode(node).Classes = [][]byte{[]byte("go")}
+			case *ast.Link:
+				mast.AttributeInit(node)
+				mast.AttributeFromNode(node).ID = []byte("l1")
+			}
+			return ast.GoToNext
+		})
+	}
+	tests := []renderTest{
+		{
+			"Some *text*, `code` and [a link](https://example.org) here.\n",
+			"Some *text*{.class}, `code`{.go} and [a link](https://example.org){#l1} here.",
+			RendererOptions{},
+		},
+	}
+	testRenderAST(t, tests, attr)
+}
+
+func TestCrossReferenceText(t *testing.T) {
+	testRender(t, []renderTest{{"See (#sec:x) for details.\n", "See (#sec:x) for details.", RendererOptions{}}})
+
+	text := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if _, ok := node.(*ast.CrossReference); ok && entering {
+				ast.AppendChild(node, &ast.Text{Leaf: ast.Leaf{Literal: []byte("Section X")}})
+			}
+			return ast.GoToNext
+		})
+	}
+	tests := []renderTest{
+		{"See (#sec:x) for details.\n", "See [Section X](#sec:x) for details.", RendererOptions{}},
+	}
+	testRenderAST(t, tests, text)
+}
+
+func TestHeadingAlign(t *testing.T) {
+	in := "# One\n\n## Two\n\n### Three\n\n#### Four\n\n##### Five\n\n.# Abstract\n"
+	tests := []renderTest{
+		{in, "# One\n\n## Two\n\n### Three\n\n#### Four\n\n##### Five\n\n.# Abstract", RendererOptions{}},
+		{in, "#    One\n\n##   Two\n\n###  Three\n\n#### Four\n\n##### Five\n\n.#   Abstract", RendererOptions{HeadingAlign: 5}},
+		{"## Two {#two-id}\n", "##   Two {#two-id}", RendererOptions{HeadingAlign: 5}},
+	}
+	testRender(t, tests)
+}
+
+func TestTitleQuote(t *testing.T) {
+	single := RendererOptions{TitleQuote: '\''}
+	tests := []renderTest{
+		{`[link](https://example.org "Title")`, `[link](https://example.org "Title")`, RendererOptions{}},
+		{`[link](https://example.org "Title")`, `[link](https://example.org 'Title')`, single},
+		{`![image](img.png 'Title')`, `![image](img.png "Title")`, RendererOptions{}},
+		{`[link](https://example.org "It's")`, `[link](https://example.org 'It\'s')`, single},
+		{`[link](https://example.org 'say "hi"')`, `[link](https://example.org "say \"hi\"")`, RendererOptions{}},
+		{`[link](https://example.org "It's "hi"")`, `[link](https://example.org "It's \"hi\"")`, RendererOptions{}},
+		{`[link](https://example.org "It's \"hi\"")`, `[link](https://example.org "It's \"hi\"")`, RendererOptions{}},
+		{"[link][1]\n\n[1]: https://example.org \"Title\"\n", "[link][1]\n\n[1]: https://example.org 'Title'", single},
+	}
+	testRender(t, tests)
+}
+
+func TestPlaceholders(t *testing.T) {
+	tests := []renderTest{
+		{"# About {{.rfc-number}}\n", "# About {{.rfc-number}}", RendererOptions{}},
+		{"## {{.draft-name}} Changes {#changes}\n", "## {{.draft-name}} Changes {#changes}", RendererOptions{}},
+		{"This is {{.rfc-number}} in {{.draft-name}}.\n", "This is {{.rfc-number}} in {{.draft-name}}.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestTableColumnWidth(t *testing.T) {
+	// a later cell that is one longer than an earlier one widens the column, and the first column is
+	// as wide as the others.
+	in := "A | B | C\n---|---|---\nBob | 1 | Paris\nAlice | 13 | Rome\n"
+	out := `A     | B  | C
+------|----|-------
+Bob   | 1  | Paris
+Alice | 13 | Rome`
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestTableNarrowColumns(t *testing.T) {
+	// a separator needs at least three characters, also for a column of a single character, else the
+	// output isn't a table anymore when it's formatted again.
+	tests := []renderTest{
+		{"A | B\n---|---\n1 | 2\n", "A  | B\n---|---\n1  | 2", RendererOptions{}},
+		{"A | B\n--:|:--\n1 | 2\n", "A  | B\n--:|:--\n1  | 2", RendererOptions{}},
+		{"Abc | B\n---|---\n1 | 2\n", "Abc| B\n---|---\n1  | 2", RendererOptions{MaxWidth: 6}},
+	}
+	testRender(t, tests)
+
+	for i, test := range tests {
+		// the columns aren't shrunk below their minimum, so MaxWidth isn't always met, see TestMaxWidth.
+		out, _ := Format([]byte(test.in), test.opts)
+		out, _ = Format(out, test.opts)
+		if x := string(bytes.TrimRight(out, "\n")); x != test.out {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, test.out, x)
+		}
+		doc := markdown.Parse(out, parser.NewWithExtensions(mparser.Extensions&^parser.Includes))
+		if _, ok := doc.GetChildren()[0].(*ast.Table); !ok {
+			t.Errorf("Test %d, expected a table when reparsed, got %T", i, doc.GetChildren()[0])
+		}
+	}
+}
+
+func TestTableFooterCells(t *testing.T) {
+	in := "Name | Age | City\n-----|-----|-----\nBob | 12 | Paris\n=====|=====|=====\nTotal | 1\n"
+	// the parser pads rows to the header's cell count, remove the padding to get a short footer.
+	short := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if footer, ok := node.(*ast.TableFooter); ok && entering {
+				row := footer.GetChildren()[0]
+				ast.RemoveFromTree(ast.GetLastChild(row))
+				return ast.SkipChildren
+			}
+			return ast.GoToNext
+		})
+	}
+	out := `Name  | Age | City
+------|-----|-------
+Bob   | 12  | Paris
+======|=====|=======
+Total | 1   |`
+	testRenderAST(t, []renderTest{{in, out, RendererOptions{}}}, short)
+}
+
+func TestPreserveFenceLength(t *testing.T) {
+	in := "`````` go\nfmt.Println()\n``````\n"
+	// the parser doesn't record the fence, set it here.
+	fence := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if code, ok := node.(*ast.CodeBlock); ok {
+				code.FenceChar = '`'
+				code.FenceLength = 6
+			}
+			return ast.GoToNext
+		})
+	}
+	tests := []renderTest{
+		{in, "~~~ go\nfmt.Println()\n~~~", RendererOptions{}},
+		{in, "`````` go\nfmt.Println()\n``````", RendererOptions{PreserveFenceLength: true}},
+	}
+	testRenderAST(t, tests, fence)
+}
+
+func TestCodeTrailingSpaces(t *testing.T) {
+	tests := []renderTest{
+		{"~~~ md\nA hard break  \nin markdown\n~~~\n", "~~~ md\nA hard break  \nin markdown\n~~~", RendererOptions{}},
+		{"> ~~~\n> code  \n> ~~~\n", "> ~~~\n> code  \n> ~~~", RendererOptions{}},
+		{"Text   \n\n~~~\ncode  \n~~~\n\nText\n", "Text\n\n~~~\ncode  \n~~~\n\nText", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestCodeInList(t *testing.T) {
+	in := "* Item with code:\n\n    ~~~ python\n    def f():\n    \tif x:\n    \t    return 1\n    ~~~\n\n* Next\n"
+	out := " *  Item with code:\n\n    ~~~ python\n    def f():\n    \tif x:\n    \t    return 1\n    ~~~\n\n *  Next"
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestRenderWriter(t *testing.T) {
+	tests := []string{`# Heading
+
+A paragraph with a [link][1] that is long enough to be wrapped when it is reflowed by the
+renderer.
+
+Name | Age
+-----|----
+Bob | 12
+
+[1]: https://example.org
+`,
+		// a line longer than the 64KB a bufio.Scanner can handle.
+		"Code:\n\n~~~\n" + strings.Repeat("x", 100000) + "\n~~~\n",
+	}
+	for i, in := range tests {
+		parse := func() ast.Node {
+			p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+			return markdown.Parse([]byte(in), p)
+		}
+		expected := markdown.Render(parse(), NewRenderer(RendererOptions{TextWidth: 40}))
+
+		pr, pw := io.Pipe()
+		go func() {
+			doc := parse()
+			r := NewRenderer(RendererOptions{TextWidth: 40})
+			r.RenderHeader(pw, doc)
+			ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+				return r.RenderNode(pw, node, entering)
+			})
+			r.RenderFooter(pw, doc)
+			pw.Close()
+		}()
+		out, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, expected, out)
+		}
+	}
+}
+
+func TestCodeIndent(t *testing.T) {
+	opts := RendererOptions{CodeIndent: 2}
+	tests := []renderTest{
+		{"Text\n\n~~~ go\nx := 1\n~~~\n", "Text\n\n  ~~~ go\nx := 1\n  ~~~", opts},
+		{"Text\n\n  ~~~ go\nx := 1\n  ~~~\n", "Text\n\n  ~~~ go\nx := 1\n  ~~~", opts},
+		{"* Item\n\n    ~~~\n    x := 1\n    ~~~\n", " *  Item\n\n    ~~~\n    x := 1\n    ~~~", opts},
+		{"~~~\nx := 1\n~~~\n", "~~~\nx := 1\n~~~", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestTypedAside(t *testing.T) {
+	// The type of an aside is carried in its attribute.
+	tests := []renderTest{
+		{"A> A plain aside.\n", "A> A plain aside.", RendererOptions{}},
+		{"{.note}\nA> A note aside.\n", "{.note}\nA> A note aside.", RendererOptions{}},
+		{"{.warning #w1}\nA> Be careful.\n", "{#w1 .warning}\nA> Be careful.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestPrefixes(t *testing.T) {
+	in := "> A quote.\n>\n> > Nested.\n\nA> An aside.\n"
+	tests := []renderTest{
+		{in, "> A quote.\n>\n> > Nested.\n\nA> An aside.", RendererOptions{}},
+		{in, ">A quote.\n>\n>>Nested.\n\nA>An aside.", RendererOptions{QuotePrefix: ">", AsidePrefix: "A>"}},
+		{in, "> A quote.\n>\n> > Nested.\n\nA> An aside.", RendererOptions{AsidePrefix: "A:"}},
+	}
+	testRender(t, tests)
+
+	for _, opts := range []RendererOptions{{QuotePrefix: "|"}, {QuotePrefix: "A>"}, {AsidePrefix: "A:"}, {AsidePrefix: ">"}} {
+		if err := NewRenderer(opts).Err(); err == nil {
+			t.Errorf("Expected error for prefixes %q and %q, got none", opts.QuotePrefix, opts.AsidePrefix)
+		}
+	}
+}
+
+// There are no admonition nodes, a see also is written as an aside.
+func TestSeeAlsoAside(t *testing.T) {
+	in := "# Intro\n\nA> See also: (#intro) and [@RFC2119].\n"
+	out := "# Intro\n\nA> See also: (#intro) and [@RFC2119]."
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestRenderMatter(t *testing.T) {
+	in := `%%%
+title = "Example"
+%%%
+
+.# Abstract
+
+This is the abstract.
+
+{mainmatter}
+
+# Introduction
+
+Some text.
+
+{backmatter}
+
+# Appendix
+
+More text.
+`
+	tests := []struct {
+		matter ast.DocumentMatters
+		out    string
+	}{
+		{ast.DocumentMatterFront, ".# Abstract\n\nThis is the abstract."},
+		{ast.DocumentMatterMain, "# Introduction\n\nSome text."},
+		{ast.DocumentMatterBack, "# Appendix\n\nMore text."},
+	}
+
+	p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+	p.Opts = parser.Options{ParserHook: mparser.TitleHook}
+	doc := markdown.Parse([]byte(in), p)
+
+	// use the same renderer for all calls, to check the state is reset.
+	r := NewRenderer(RendererOptions{})
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		r.RenderMatter(buf, doc, test.matter)
+		out := bytes.TrimRight(buf.Bytes(), " \n")
+		if string(out) != test.out {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, test.out, out)
+		}
+	}
+}
+
+type unknownNode struct {
+	ast.Leaf
+}
+
+func TestUnknownNode(t *testing.T) {
+	p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+	doc := markdown.Parse([]byte("Some text.\n"), p)
+	ast.AppendChild(doc, &unknownNode{})
+
+	r := NewRenderer(RendererOptions{})
+	out := markdown.Render(doc, r)
+	if x := "Some text."; string(bytes.TrimRight(out, " \n")) != x {
+		t.Errorf("Expected %q, got %q", x, out)
+	}
+	if r.Err() == nil {
+		t.Errorf("Expected error for unknown node, got none")
+	}
+}
+
+func TestHTMLBlockSpacing(t *testing.T) {
+	in := "<table>\n<tr><td>a</td></tr>\n</table>\n\nA paragraph.\n"
+	out := "<table>\n<tr><td>a</td></tr>\n</table>\n\nA paragraph."
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+
+	// give the HTML block trailing newlines, these should not lead to extra empty lines.
+	newlines := func(doc ast.Node) {
+		html := doc.GetChildren()[0].(*ast.HTMLBlock)
+		html.Literal = append([]byte(string(html.Literal)), "\n\n\n"...)
+	}
+	testRenderAST(t, []renderTest{{in, out, RendererOptions{}}}, newlines)
+}
+
+func TestHTMLComments(t *testing.T) {
+	tests := []renderTest{
+		{
+			"Text before.\n\n<!-- a comment block\nover two lines -->\n\nText after.\n",
+			"Text before.\n\n<!-- a comment block\nover two lines -->\n\nText after.",
+			RendererOptions{},
+		},
+		{
+			"Inline <!-- more --> comment.\n",
+			"Inline <!-- more --> comment.",
+			RendererOptions{},
+		},
+	}
+	testRender(t, tests)
+}
+
+func TestHTMLCommentBlock(t *testing.T) {
+	in := "Text before.\n\n<!--\nA comment block.\n\n\n  Indented, after two empty lines.\n-->\n\nText after.\n"
+	out := "Text before.\n\n<!--\nA comment block.\n\n\n  Indented, after two empty lines.\n-->\n\nText after."
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestCitationLocators(t *testing.T) {
+	in := "See [@RFC2119, Section 2] and [@RFC8174; @!RFC7991, Section 3].\n"
+	tests := []renderTest{
+		{in, "See [@RFC2119, Section 2] and [@RFC8174; @!RFC7991, Section 3].", RendererOptions{}},
+		{in, "See [@RFC2119, Abschnitt 2] and [@RFC8174; @!RFC7991, Abschnitt 3].",
+			RendererOptions{CitationLocators: map[string]string{"Section": "Abschnitt"}}},
+		{"See [@RFC2119, p. 2].\n", "See [@RFC2119, p. 2].",
+			RendererOptions{CitationLocators: map[string]string{"Section": "Abschnitt"}}},
+	}
+	testRender(t, tests)
+}
+
+func TestCitationGroup(t *testing.T) {
+	// each citation in a group starts with @ and they are separated by a ;, a , would start a suffix.
+	in := "See [@RFC2119;@!RFC8174;   @-RFC7991].\n"
+	out := "See [@RFC2119; @!RFC8174; @-RFC7991]."
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+
+	// when parsed again, all references are still there.
+	doc := markdown.Parse([]byte(out), parser.NewWithExtensions(mparser.Extensions&^parser.Includes))
+	var cite *ast.Citation
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if c, ok := node.(*ast.Citation); ok {
+			cite = c
+		}
+		return ast.GoToNext
+	})
+	if cite == nil || len(cite.Destination) != 3 {
+		t.Fatalf("Expected a citation with 3 references, got %v", cite)
+	}
+}
+
+func TestCompactCitations(t *testing.T) {
+	in := "See [@RFC2119;@!RFC8174,   Section 2].\n"
+	tests := []renderTest{
+		{in, "See [@RFC2119; @!RFC8174, Section 2].", RendererOptions{}},
+		{in, "See [@RFC2119;@!RFC8174,Section 2].", RendererOptions{CompactCitations: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestCitationTrailingSeparator(t *testing.T) {
+	// an empty reference would be output as a trailing separator, which the parser can't handle.
+	empty := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if c, ok := node.(*ast.Citation); ok {
+				c.Destination = append(c.Destination, []byte{})
+				c.Type = append(c.Type, ast.CitationTypeInformative)
+			}
+			return ast.GoToNext
+		})
+	}
+	tests := []renderTest{
+		{"See [@RFC2119; @RFC8174].\n", "See [@RFC2119; @RFC8174].", RendererOptions{}},
+		{"See [@RFC2119; @RFC8174].\n", "See [@RFC2119;@RFC8174].", RendererOptions{CompactCitations: true}},
+	}
+	testRenderAST(t, tests, empty)
+}
+
+func TestEmphasizedLink(t *testing.T) {
+	tests := []renderTest{
+		{"An *[emphasized link](https://example.org)* here.\n", "An *[emphasized link](https://example.org)* here.", RendererOptions{}},
+		{"A **[strong link][1]** here.\n\n[1]: https://example.org\n", "A **[strong link][1]** here.\n\n[1]: https://example.org", RendererOptions{}},
+		{"A *link to <https://example.org>* here.\n", "A *link to <https://example.org>* here.", RendererOptions{}},
+		{"A [*emphasis* in a link](https://example.org).\n", "A [*emphasis* in a link](https://example.org).", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestEmptyPrefixLines(t *testing.T) {
+	in := "> First paragraph.\n>\n> Second paragraph.\n"
+	tests := []renderTest{
+		{in, "> First paragraph.\n>\n> Second paragraph.", RendererOptions{}},
+		{in, "> First paragraph.\n\n> Second paragraph.", RendererOptions{EmptyPrefixLines: true}},
+		{"A> Aside one.\nA>\nA> Aside two.\n", "A> Aside one.\n\nA> Aside two.", RendererOptions{EmptyPrefixLines: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestWrapMode(t *testing.T) {
+	in := "This is the first sentence. Is this the second one? Yes! It ends here, e.g. with an\nabbreviation, see Fig. 2 by J. Doe etc. and \"Quoted.\" Done (really.) Last.\n"
+	tests := []renderTest{
+		{in, `This is the first sentence. Is this the second one? Yes! It ends here, e.g. with
+an abbreviation, see Fig. 2 by J. Doe etc. and "Quoted." Done (really.) Last.`, RendererOptions{}},
+		{in, `This is the first sentence. Is this the second one? Yes! It ends here, e.g. with an abbreviation, see Fig. 2 by J. Doe etc. and "Quoted." Done (really.) Last.`,
+			RendererOptions{WrapMode: WrapNone}},
+		{in, `This is the first sentence.
+Is this the second one?
+Yes!
+It ends here, e.g. with an abbreviation, see Fig. 2 by J. Doe etc. and "Quoted."
+Done (really.)
+Last.`, RendererOptions{WrapMode: WrapSentence}},
+		{"> One. Two.\n", "> One.\n> Two.", RendererOptions{WrapMode: WrapSentence}},
+	}
+	testRender(t, tests)
+}
+
+func TestTableRagged(t *testing.T) {
+	in := "A | B | C\n---|---|---\nBob | 12 | Paris\nAlice | 13 | Rome\n"
+	// the parser makes all rows equally long, make the first body row shorter and the second longer.
+	ragged := func(doc ast.Node) {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if body, ok := node.(*ast.TableBody); ok && entering {
+				rows := body.GetChildren()
+				ast.RemoveFromTree(ast.GetLastChild(rows[0]))
+				ast.RemoveFromTree(ast.GetLastChild(rows[0]))
+				cell := &ast.TableCell{}
+				ast.AppendChild(cell, &ast.Text{Leaf: ast.Leaf{Literal: []byte("Extra")}})
+				ast.AppendChild(rows[1], cell)
+				return ast.SkipChildren
+			}
+			return ast.GoToNext
+		})
+	}
+	out := `A     | B  | C    |       |
+------|----|------|-------
+Bob   |    |      |
+Alice | 13 | Rome | Extra`
+	testRenderAST(t, []renderTest{{in, out, RendererOptions{}}}, ragged)
+
+	// the header has as many cells as the separator, so the output is still a table and stays the same.
+	testRender(t, []renderTest{{out, out, RendererOptions{}}})
+	doc := markdown.Parse([]byte(out), parser.NewWithExtensions(mparser.Extensions&^parser.Includes))
+	if _, ok := doc.GetChildren()[0].(*ast.Table); !ok {
+		t.Errorf("Expected a table when reparsed, got %T", doc.GetChildren()[0])
+	}
+}
+
+func TestUnSmartypants(t *testing.T) {
+	in := "“Quoted” and ‘single’, it’s 1–2 — wait…\n"
+	tests := []renderTest{
+		{in, "“Quoted” and ‘single’, it’s 1–2 — wait…", RendererOptions{}},
+		{in, `"Quoted" and 'single', it's 1--2 --- wait...`, RendererOptions{UnSmartypants: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestNormalizeTypography(t *testing.T) {
+	in := "Pages 1--2 --- or not; `a --- b`, <https://example.org/a--b> and a --> b.\n"
+	tests := []renderTest{
+		{in, "Pages 1--2 --- or not; `a --- b`, <https://example.org/a--b> and a --> b.", RendererOptions{}},
+		{in, "Pages 1\u20132 \u2014 or not; `a --- b`, <https://example.org/a--b> and a --> b.",
+			RendererOptions{NormalizeTypography: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestCodeTabs(t *testing.T) {
+	tests := []renderTest{
+		{"~~~ make\nall:\n\tgo build ./...\n\techo \"\tdone\"\n~~~\n", "~~~ make\nall:\n\tgo build ./...\n\techo \"\tdone\"\n~~~", RendererOptions{}},
+		{"> ~~~\n> all:\n> \tgo build\n> ~~~\n", "> ~~~\n> all:\n> \tgo build\n> ~~~", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestSuperscriptFootnote(t *testing.T) {
+	// The parser eats text after a superscript, so put the superscript in the tree ourselves.
+	sup := func(doc ast.Node) {
+		para := doc.GetChildren()[0]
+		children := para.GetChildren()
+		children[0].(*ast.Text).Literal = []byte("A note")
+		sup := &ast.Superscript{Leaf: ast.Leaf{Literal: []byte("1")}}
+		text := &ast.Text{Leaf: ast.Leaf{Literal: []byte(" versus a footnote")}}
+		sup.SetParent(para)
+		text.SetParent(para)
+		para.SetChildren(append([]ast.Node{children[0], sup, text}, children[1:]...))
+	}
+	tests := []renderTest{
+		{"A note versus a footnote[^1].\n\n[^1]: The footnote.\n", "A note^1^ versus a footnote[^1].\n\n[^1]: The footnote.", RendererOptions{}},
+	}
+	testRenderAST(t, tests, sup)
+}
+
+func TestAlwaysEmitHeadingID(t *testing.T) {
+	opts := RendererOptions{AlwaysEmitHeadingID: true}
+	tests := []renderTest{
+		{"# Introduction {#introduction}\n", "# Introduction", RendererOptions{}},
+		{"# Introduction {#intro}\n", "# Introduction {#intro}", RendererOptions{}},
+		{"# Introduction {#introduction}\n", "# Introduction {#introduction}", opts},
+		{"# Introduction {#intro}\n", "# Introduction {#intro}", opts},
+		{"# Introduction {#introduction}\n", "{#introduction}\nIntroduction\n============", RendererOptions{AlwaysEmitHeadingID: true, SetextHeadings: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestAlwaysEmitHeadingIDGenerated(t *testing.T) {
+	in := "# Introduction\n\n## The *Second* Section\n\n.# Abstract\n\n# Introduction\n\n# Other {#intro}\n"
+	out := `# Introduction {#introduction}
+
+## The *Second* Section {#the-second-section}
+
+.# Abstract {#abstract}
+
+# Introduction {#introduction-1}
+
+# Other {#intro}`
+	// a generated ID must not clash with an explicit one, even when that comes later.
+	in1 := "# Intro\n\n# Intro\n\n# Intro {#intro-1}\n"
+	out1 := "# Intro {#intro}\n\n# Intro {#intro-2}\n\n# Intro {#intro-1}"
+	tests := []renderTest{
+		{in, out, RendererOptions{AlwaysEmitHeadingID: true}},
+		{in1, out1, RendererOptions{AlwaysEmitHeadingID: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestCommonMarkStrict(t *testing.T) {
+	opts := RendererOptions{CommonMarkStrict: true}
+	tests := []renderTest{
+		{"%%%\ntitle = \"Example\"\n%%%\n\n# Heading\n", "# Heading", opts},
+		{".# Abstract\n\nText.\n", "# Abstract\n\nText.", opts},
+		{"# Introduction {#intro}\n", "# Introduction", opts},
+		{"{mainmatter}\n\n# Heading\n\n{backmatter}\n", "# Heading", opts},
+		{"A> An aside.\n", "> An aside.", opts},
+		{"See [@RFC2119, Section 2; @!RFC8174].\n", "See [RFC2119, Section 2](#RFC2119); [RFC8174](#RFC8174).", opts},
+		{"See (#intro).\n", "See [intro](#intro).", opts},
+		{"Some (!index) text.\n", "Some text.", opts},
+		{"{.class}\nA paragraph.\n", "A paragraph.", opts},
+		{"Name | Age\n-----|----\nBob | 1\nTable: Ages {#ages}\n", "Name | Age\n-----|-----\nBob  | 1\n\nTable: Ages", opts},
+		{"Term\n: Definition\n", "Term\n\n *  Definition", opts},
+		{"Term\n: \n\nOther\n: Definition\n", "Term\n\n *\n\nOther\n\n *  Definition", opts},
+		{"H~2~O\n", "H<sub>2</sub>O", opts},
+		{"E = mc^2^\n", "E = mc<sup>2</sup>", opts},
+		{"Text $x_1$ here.\n", "Text `x_1` here.", opts},
+		{"$$\nx = 1\n$$\n", "~~~ math\nx = 1\n~~~", opts},
+		{"!---\n![a](b.png)\n!---\nFigure: Images.\n", "![a](b.png)\n\nFigure: Images.", opts},
+		{"> !---\n> ![a](b.png)\n> !---\n> Figure: Images.\n", "> ![a](b.png)\n>\n> Figure: Images.", opts},
+		{"> !---\n> ![a](b.png)\n> !---\n> Figure: Images.\n", "> !---\n> ![a](b.png)\n> !---\n> Figure: Images.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestListMultiParagraph(t *testing.T) {
+	tests := []renderTest{
+		{"* First paragraph.\n\n    Second paragraph.\n\n* Next item.\n", " *  First paragraph.\n\n    Second paragraph.\n\n *  Next item.", RendererOptions{}},
+		{"1. One.\n\n    Two.\n\n2. Three.\n", "1.  One.\n\n    Two.\n\n2.  Three.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestIncludes(t *testing.T) {
+	opts := RendererOptions{TextWidth: 40}
+	tests := []renderTest{
+		{"Text.\n\n{{include.md}}\n\nEnd.\n", "Text.\n\n{{include.md}}\n\nEnd.", opts},
+		{"Text.\n\n{{include.md}}[4,10]\n\nEnd.\n", "Text.\n\n{{include.md}}[4,10]\n\nEnd.", opts},
+		{"<{{code.go}}[/START/,/END/]\nFigure: Code.\n", "<{{code.go}}[/START/,/END/]\nFigure: Code.", opts},
+		{"{{path/to/a/long/file/name.md}}[/start of the section/,/end of the section/]\n",
+			"{{path/to/a/long/file/name.md}}[/start of the section/,/end of the section/]", opts},
+		{"* Item\n\n    {{list.md}}\n", " *  Item\n\n    {{list.md}}", opts},
+	}
+	testRender(t, tests)
+}
+
+// The parser has no bracketed span node, the span is text and must be kept as is.
+func TestBracketedSpan(t *testing.T) {
+	tests := []renderTest{
+		{"Some [text]{.class #id} here.\n", "Some [text]{.class #id} here.", RendererOptions{}},
+		{"Some [*emphasized* text]{.class} here.\n", "Some [*emphasized* text]{.class} here.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+// A cell in a pipe table can't span multiple lines, so a cell wider than its (capped) column is
+// never wrapped or truncated, it is output whole.
+func TestTableCellNoWrap(t *testing.T) {
+	in := "Name | Description\n-----|------------\nBob | Words that do not fit in the column\n"
+	out := `Name | Description
+-----|--------------------
+Bob  | Words that do not fit in the column`
+	testRender(t, []renderTest{{in, out, RendererOptions{MaxWidth: 26}}})
+}
+
+func TestMaxTableColWidth(t *testing.T) {
+	// A pipe table cell can't be wrapped onto multiple lines without creating extra rows. The cap only
+	// limits the column (and its separator) width, a longer cell overflows its column and is not padded.
+	in := "Name | Description\n-----|------------\nBob | A rather long description of Bob\nAlice | Short\n"
+	out := `Name  | Description
+------|-------------
+Bob   | A rather long description of Bob
+Alice | Short`
+	testRender(t, []renderTest{{in, out, RendererOptions{MaxTableColWidth: 12}}})
+}
+
+func TestBulletMarker(t *testing.T) {
+	in := "* Item 1\n    + Nested\n        - Deeper\n* Item 2\n"
+	tests := []renderTest{
+		{in, " *  Item 1\n     -  Nested\n         *  Deeper\n *  Item 2", RendererOptions{}},
+		{in, " *  Item 1\n     *  Nested\n         *  Deeper\n *  Item 2", RendererOptions{BulletMarker: '*'}},
+		{in, " -  Item 1\n     -  Nested\n         -  Deeper\n -  Item 2", RendererOptions{BulletMarker: '-'}},
+		{in, " +  Item 1\n     +  Nested\n         +  Deeper\n +  Item 2", RendererOptions{BulletMarker: '+'}},
+		{in, " *  Item 1\n     -  Nested\n         *  Deeper\n *  Item 2", RendererOptions{BulletMarker: 'x'}},
+	}
+	testRender(t, tests)
+
+	if err := NewRenderer(RendererOptions{BulletMarker: 'x'}).Err(); err == nil {
+		t.Errorf("Expected error for bullet marker 'x', got none")
+	}
+}
+
+func TestBlankBeforeList(t *testing.T) {
+	in := "* item 1\n    * nested\n* item 2\n\nA paragraph.\n\n* item\n"
+	opts := RendererOptions{BlankBeforeList: true}
+	// the empty line before the nested list makes the outer list loose, so it's output as one.
+	loose := " *  item 1\n\n     -  nested\n\n *  item 2\n\nA paragraph.\n\n *  item"
+	tests := []renderTest{
+		{in, " *  item 1\n     -  nested\n *  item 2\n\nA paragraph.\n\n *  item", RendererOptions{}},
+		{in, loose, opts},
+		{loose, loose, opts},
+		{" *  item 1\n\n     -  nested\n *  item 2\n", " *  item 1\n\n     -  nested\n\n *  item 2", opts},
+		{" *  item 1\n\n     -  nested\n\n *  item 2\n", " *  item 1\n\n     -  nested\n\n *  item 2", opts},
+		// a list can't interrupt a paragraph, this is a single paragraph.
+		{"A paragraph.\n* item\n", "A paragraph. * item", opts},
+	}
+	testRender(t, tests)
+}
+
+func TestOrderedListThreeDigits(t *testing.T) {
+	in := "98. item\n99. item\n100. an item with a longer text that wraps\n101. item\n"
+	out := `98.   item
+99.   item
+100.  an item with a longer
+      text that wraps
+101.  item`
+	testRender(t, []renderTest{{in, out, RendererOptions{TextWidth: 30}}})
+}
+
+func TestLazyListNumbers(t *testing.T) {
+	tests := []renderTest{
+		{"1. one\n1. two\n1. three\n", "1.  one\n2.  two\n3.  three", RendererOptions{}},
+		{"1. one\n1. two\n1. three\n", "1.  one\n1.  two\n1.  three", RendererOptions{LazyListNumbers: true}},
+		{"3. one\n4. two\n", "3.  one\n3.  two", RendererOptions{LazyListNumbers: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestCanonicalizeAttributes(t *testing.T) {
+	in := "{.b key2=\"2\" #id .a key1=\"1\" .b}\nA paragraph.\n"
+	tests := []renderTest{
+		{in, "{#id .b .a .b key1=\"1\" key2=\"2\"}\nA paragraph.", RendererOptions{}},
+		{in, "{#id .a .b key1=\"1\" key2=\"2\"}\nA paragraph.", RendererOptions{CanonicalizeAttributes: true}},
+		{"{.z .y}\n# Heading\n", "{.y .z}\n# Heading", RendererOptions{CanonicalizeAttributes: true}},
+	}
+	testRender(t, tests)
+}
+
+func TestSpecialHeadingAttribute(t *testing.T) {
+	in := "{#abs .class}\n.# Abstract\n\nText.\n"
+	tests := []renderTest{
+		{in, "{#abs .class}\n.# Abstract\n\nText.", RendererOptions{}},
+		{in, "{#abs .class}\n.#  Abstract\n\nText.", RendererOptions{HeadingAlign: 4}},
+	}
+	testRender(t, tests)
+}
+
+// The status is part of the title block, a {{.status}} directive is kept as text.
+func TestStatus(t *testing.T) {
+	in := "%%%\ntitle = \"Example\"\n\n[seriesInfo]\nname = \"RFC\"\nvalue = \"8888\"\nstatus = \"informational\"\n%%%\n\n{{.status}}\n"
+	out := "%%%\ntitle = \"Example\"\n\n[seriesInfo]\nname = \"RFC\"\nvalue = \"8888\"\nstatus = \"informational\"\n%%%\n\n{{.status}}"
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestMinimalEmphasis(t *testing.T) {
+	opts := RendererOptions{MinimalEmphasis: true}
+	tests := []renderTest{
+		{"An *emphasis* and **strong**.\n", "An *emphasis* and **strong**.", RendererOptions{}},
+		{"An *emphasis* and **strong**.\n", "An _emphasis_ and __strong__.", opts},
+		{"Intra*word*emphasis.\n", "Intra*word*emphasis.", opts},
+		{"Nested _a **b** c_ here.\n", "Nested _a **b** c_ here.", opts},
+		{"Nested **a *b* c** here.\n", "Nested __a *b* c__ here.", opts},
+		{"Ends *with_* underscore.\n", "Ends *with_* underscore.", opts},
+	}
+	testRender(t, tests)
+}
+
+func TestNestedEmphasis(t *testing.T) {
+	tests := []renderTest{
+		{"A ***bold italic*** text.\n", "A ***bold italic*** text.", RendererOptions{}},
+		{"A **a *b* c** text.\n", "A **a *b* c** text.", RendererOptions{}},
+		{"A _a **b** c_ text.\n", "A _a **b** c_ text.", RendererOptions{}},
+		{"A _**a** b_ text.\n", "A _**a** b_ text.", RendererOptions{}},
+		{"A **a** *b* text.\n", "A **a** *b* text.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestCodeSpanBackticks(t *testing.T) {
+	tests := []renderTest{
+		{"Code `a` here.\n", "Code `a` here.", RendererOptions{}},
+		{"Code ``a`b`` here.\n", "Code ``a`b`` here.", RendererOptions{}},
+		{"Code ```x``y``` here.\n", "Code ```x``y``` here.", RendererOptions{}},
+		{"Code `` `tick` `` here.\n", "Code `` `tick` `` here.", RendererOptions{}},
+		{"Code ``` ``x`` ``` here.\n", "Code ``` ``x`` ``` here.", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestPrefixWiderThanTextWidth(t *testing.T) {
+	in := "> > > > > > Deeply nested quote with words.\n> > > > > >\n> > > > > > * a list item\n"
+	out := `> > > > > > Deeply
+> > > > > > nested
+> > > > > > quote
+> > > > > > with
+> > > > > > words.
+> > > > > >
+> > > > > >  *  a
+> > > > > >     list
+> > > > > >     item`
+	testRender(t, []renderTest{{in, out, RendererOptions{TextWidth: 10}}})
+}
+
+func TestTableCrossReference(t *testing.T) {
+	in := "Name | Ref\n-----|----\nBob | See (#sec:intro)\nAlice | Short\n"
+	out := `Name  | Ref
+------|------------------
+Bob   | See (#sec:intro)
+Alice | Short`
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestWalkLink(t *testing.T) {
+	p := parser.NewWithExtensions(mparser.Extensions &^ parser.Includes)
+	doc := markdown.Parse([]byte("See [the *example* site](https://example.org \"Example\") and ![an image](img.png).\n"), p)
+	r := NewRenderer(RendererOptions{})
+	buf := &bytes.Buffer{}
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch node.(type) {
+		case *ast.Link, *ast.Image:
+			ast.Walk(node, ast.NodeVisitorFunc(func(node ast.Node, entering bool) ast.WalkStatus {
+				return r.RenderNode(buf, node, entering)
+			}))
+			buf.WriteString(" ")
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	if x := `[the *example* site](https://example.org "Example") ![an image](img.png) `; buf.String() != x {
+		t.Errorf("Expected %s, got %s", x, buf)
+	}
+}
+
+func TestTableLink(t *testing.T) {
+	in := "Name | Site\n-----|----\nBob | [example](https://example.org)\nAlice | Short\n"
+	out := `Name  | Site
+------|--------------------------------
+Bob   | [example](https://example.org)
+Alice | Short`
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestCollapseEmptyLines(t *testing.T) {
+	in := "%%%\ntitle = \"Example\"\n\n\n\narea = \"Internet\"\n%%%\n\n\n\nA paragraph.\n\n\n\n~~~\ncode\n\n\n\ncode\n~~~\n"
+	out := "%%%\ntitle = \"Example\"\n\narea = \"Internet\"\n%%%\n\nA paragraph.\n\n~~~\ncode\n\n\n\ncode\n~~~"
+	tests := []renderTest{
+		{in, out, RendererOptions{}},
+		// the literal content of math and HTML blocks is kept as is, as in code.
+		{"$$\nx\n\n\ny\n$$\n", "$$\nx\n\n\ny\n$$", RendererOptions{}},
+		{"<div>\nx\n</div>\n\n<!--\nx\n\n\ny\n-->\n", "<div>\nx\n</div>\n\n<!--\nx\n\n\ny\n-->", RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestTableInQuote(t *testing.T) {
+	in := "> > Name | Age\n> > :---|---:\n> > Bob | 27\n"
+	out := "> > Name | Age\n> > :----|----:\n> > Bob  | 27"
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestHighlight(t *testing.T) {
+	// The parser has no highlight or insert nodes, the markers are kept as text.
+	in := "Some ==highlighted== and ++inserted++ text.\n"
+	out := "Some ==highlighted== and ++inserted++ text."
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestCompactTables(t *testing.T) {
+	in := "Name | Age\n:----|---:\nBob | 27\nAlice |\n=====|====\nTotal | 50\n"
+	padded := `Name  | Age
+:-----|----:
+Bob   | 27
+Alice |
+======|=====
+Total | 50`
+	compact := `Name|Age
+:--|--:
+Bob|27
+Alice|
+===|===
+Total|50`
+	tests := []renderTest{
+		{in, padded, RendererOptions{}},
+		{in, compact, RendererOptions{CompactTables: true}},
+		// both forms are the same table.
+		{compact + "\n", padded, RendererOptions{}},
+	}
+	testRender(t, tests)
+}
+
+func TestTableFootnote(t *testing.T) {
+	in := "Name | Note\n-----|----\nBob | See[^1] here\nAlice | Short^[inline note]\n\n[^1]: The footnote.\n\nText.\n"
+	out := `Name  | Note
+------|---------------------
+Bob   | See[^1] here
+Alice | Short^[inline note]
+
+Text.
+
+[^1]: The footnote.`
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestTableImage(t *testing.T) {
+	in := "Name | Logo\n-----|----\nBob | ![logo](bob.png \"Bob\")\nAlice | Short\n"
+	out := `Name  | Logo
+------|------------------------
+Bob   | ![logo](bob.png "Bob")
+Alice | Short`
+	testRender(t, []renderTest{{in, out, RendererOptions{}}})
+}
+
+func TestTableHook(t *testing.T) {
+	in := "Name | Description\n-----|------------\nBob | Tall\nAlice | Short\n"
+	var got []int
+	hook := func(tab *ast.Table, widths []int) {
+		got = append([]int{}, widths...)
+		widths[1] = 15
+	}
+	out := `Name  | Description
+------|----------------
+Bob   | Tall
+Alice | Short`
+	testRender(t, []renderTest{{in, out, RendererOptions{TableHook: hook}}})
+
+	if x := []int{6, 12}; !reflect.DeepEqual(got, x) {
+		t.Errorf("Expected widths %v, got %v", x, got)
+	}
+}
+
+func TestSoftBreak(t *testing.T) {
+	// The parser keeps soft breaks in the text, create the nodes by hand.
+	para := &ast.Paragraph{}
+	ast.AppendChild(para, &ast.Text{Leaf: ast.Leaf{Literal: []byte("A first line")}})
+	ast.AppendChild(para, &ast.Softbreak{})
+	ast.AppendChild(para, &ast.Text{Leaf: ast.Leaf{Literal: []byte("and a second line.")}})
+	doc := &ast.Document{}
+	ast.AppendChild(doc, para)
+
+	tests := []struct {
+		opts RendererOptions
+		out  string
+	}{
+		{RendererOptions{}, "A first line and a second line."},
+		{RendererOptions{WrapMode: WrapPreserve}, "A first line\nand a second line."},
+	}
+	for i, tc := range tests {
+		out := markdown.Render(doc, NewRenderer(tc.opts))
+		if x := string(bytes.TrimRight(out, " \n")); x != tc.out {
+			t.Errorf("Test %d, expected:\n%s\ngot:\n%s", i, tc.out, x)
+		}
+	}
+}
+
+func TestProcessingInstruction(t *testing.T) {
+	in := "{:pi toc=\"yes\" symrefs=\"yes\" sortrefs=\"yes\"}\n\nText that is wrapped.\n"
+	out := "{:pi toc=\"yes\" symrefs=\"yes\" sortrefs=\"yes\"}\n\nText that is\nwrapped."
+	testRender(t, []renderTest{{in, out, RendererOptions{TextWidth: 15}}})
+}
+
+func TestWrapPreserve(t *testing.T) {
+	opts := RendererOptions{WrapMode: WrapPreserve, TextWidth: 20}
+	in := "A first line that is longer than the text width \n  second line\nthird\n\n> quoted one \n> quoted two\n"
+	out := "A first line that is longer than the text width\nsecond line\nthird\n\n> quoted one\n> quoted two"
+	testRender(t, []renderTest{{in, out, opts}})
+
+	again, err := Format([]byte(out), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := string(bytes.TrimRight(again, "\n")); x != out {
+		t.Errorf("Expected:\n%s\ngot:\n%s", out, x)
+	}
+}
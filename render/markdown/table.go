@@ -2,6 +2,9 @@ package markdown
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
 
 	"github.com/gomarkdown/markdown/ast"
 )
@@ -11,8 +14,10 @@ func (r *Renderer) tableColWidth(tab *ast.Table) ([]int, []ast.CellAlignFlags) {
 	ast.WalkFunc(tab, func(node ast.Node, entering bool) ast.WalkStatus {
 		switch node := node.(type) {
 		case *ast.TableRow:
-			cells = len(node.GetChildren())
-			break
+			// rows, such as a footer, may have fewer cells than the header, take the maximum.
+			if l := len(node.GetChildren()); l > cells {
+				cells = l
+			}
 		}
 		return ast.GoToNext
 	})
@@ -29,16 +34,125 @@ func (r *Renderer) tableColWidth(tab *ast.Table) ([]int, []ast.CellAlignFlags) {
 
 				buf := &bytes.Buffer{}
 				ast.WalkFunc(cell, func(node1 ast.Node, entering bool) ast.WalkStatus {
-					r.RenderNode(buf, node1, entering)
-					return ast.GoToNext
+					return r.RenderNode(buf, node1, entering)
 				})
-				if l := buf.Len(); l > width[col] {
-					width[col] = l + 1 // space in beginning or end
-
+				if l := buf.Len() + 1; l > width[col] {
+					width[col] = l // space in beginning or end
 				}
 			}
 		}
 		return ast.GoToNext
 	})
+	for i := range width {
+		if width[i] < minColWidth(i) {
+			width[i] = minColWidth(i)
+		}
+	}
 	return width, align
 }
+
+// tableMaxWidth shrinks the widest columns until the table fits in MaxWidth. Cells that are wider than
+// their (shrunk) column are not padded.
+func (r *Renderer) tableMaxWidth(width []int) {
+	if r.opts.MaxWidth == 0 || len(width) == 0 {
+		return
+	}
+	// columns are separated by a |.
+	total := r.prefix.len() + len(width) - 1
+	for i, w := range width {
+		total += r.sepWidth(i, w)
+	}
+	for total > r.opts.MaxWidth {
+		widest := -1
+		for i := range width {
+			if width[i] > minColWidth(i) && (widest < 0 || width[i] > width[widest]) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			return
+		}
+		width[widest]--
+		total--
+	}
+}
+
+// tableWidthCheck records an error when a line of the rendered table is wider than MaxWidth. Cells in
+// a pipe table can't be wrapped, so shrinking the columns doesn't always make the table fit.
+func (r *Renderer) tableWidthCheck(table []byte) {
+	if r.opts.MaxWidth == 0 {
+		return
+	}
+	widest := 0
+	for _, line := range bytes.Split(table, []byte("\n")) {
+		if width := utf8.RuneCount(bytes.TrimRight(line, " ")); width > widest {
+			widest = width
+		}
+	}
+	if widest > r.opts.MaxWidth {
+		r.errs = append(r.errs, fmt.Errorf("table is wider (%d) than the maximum width: %d", widest, r.opts.MaxWidth))
+	}
+}
+
+// tableMaxColWidth caps the width of each column to MaxTableColWidth.
+func (r *Renderer) tableMaxColWidth(width []int) {
+	if r.opts.MaxTableColWidth == 0 {
+		return
+	}
+	for i := range width {
+		max := r.opts.MaxTableColWidth
+		if max < minColWidth(i) {
+			max = minColWidth(i)
+		}
+		if width[i] > max {
+			width[i] = max
+		}
+	}
+}
+
+// sepWidth returns the width of the separator of column i. The cells in the first column start without
+// a space, the others start with a space, making them one wider. With CompactTables this is always 3.
+func (r *Renderer) sepWidth(i, width int) int {
+	if r.opts.CompactTables {
+		return 3
+	}
+	if i == 0 {
+		return width
+	}
+	return width + 1
+}
+
+// minColWidth returns the minimum width of column i. The parser needs at least three characters, alignment
+// markers included, in a separator, see sepWidth for how the separator width follows from the column width.
+func minColWidth(i int) int {
+	if i == 0 {
+		return 3
+	}
+	return 2
+}
+
+// tableRowPad pads the current row with empty cells when it has fewer cells than the table has columns.
+func (r *Renderer) tableRowPad(w io.Writer) {
+	for ; r.col < len(r.colWidth); r.col++ {
+		if !r.opts.CompactTables {
+			if r.col > 0 {
+				r.outs(w, " ")
+			}
+			r.out(w, Space(r.colWidth[r.col]))
+		}
+		if r.col == len(r.colWidth)-1 {
+			r.tableRowClose(w)
+			r.endline(w)
+		} else {
+			r.outs(w, "|")
+		}
+	}
+}
+
+// tableRowClose closes a header row that ends in an empty cell with a |. Without it the trailing spaces
+// are trimmed and the header has fewer cells than the separator, making it a paragraph when reparsed.
+func (r *Renderer) tableRowClose(w io.Writer) {
+	if _, isHeader := r.tableType.(*ast.TableHeader); isHeader {
+		r.outs(w, "|")
+	}
+}
@@ -0,0 +1,142 @@
+package markdown
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/mmarkdown/mmark/mast"
+	"github.com/mmarkdown/mmark/render/xml"
+)
+
+// titleKeys is the canonical order of the keys in the title block, per table. The top-level keys, under
+// "", follow the order of the RFC header, the keys in a table follow the order of the fields in mast.
+// Keys not listed here are left where they are.
+var titleKeys = map[string]map[string]int{
+	"": {
+		"area":           1,
+		"workgroup":      2,
+		"submissiontype": 3,
+	},
+	"seriesinfo": {
+		"name":   1,
+		"value":  2,
+		"status": 3,
+		"stream": 4,
+	},
+}
+
+var (
+	titleKey   = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+	titleTable = regexp.MustCompile(`^\s*\[+\s*([A-Za-z0-9_.-]+)\s*\]+\s*$`)
+)
+
+// titleOrder returns the title block content with the known keys in canonical order. Only the positions
+// of those keys are reused, all other lines stay as is. If a known key has a value that spans multiple
+// lines the content is returned unchanged.
+func titleOrder(content []byte) []byte {
+	lines := bytes.Split(content, []byte("\n"))
+	ordered := make([][]byte, len(lines))
+	copy(ordered, lines)
+
+	table := ""
+	pos := []int{}
+	for i := 0; i <= len(lines); i++ {
+		var t [][]byte
+		if i < len(lines) {
+			t = titleTable.FindSubmatch(lines[i])
+		}
+		if i == len(lines) || t != nil {
+			// end of the current table, order the keys we've found.
+			orderKeys(ordered, pos, titleKeys[table])
+			pos = pos[:0]
+			if t != nil {
+				table = string(bytes.ToLower(t[1]))
+			}
+			continue
+		}
+
+		m := titleKey.FindSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		if _, ok := titleKeys[table][string(m[1])]; !ok {
+			continue
+		}
+		if multiline(m[2]) {
+			return content
+		}
+		pos = append(pos, i)
+	}
+	return bytes.Join(ordered, []byte("\n"))
+}
+
+// orderKeys sorts the lines at the positions in pos according to order.
+func orderKeys(lines [][]byte, pos []int, order map[string]int) {
+	if len(pos) < 2 {
+		return
+	}
+	rank := func(l []byte) int { return order[string(titleKey.FindSubmatch(l)[1])] }
+
+	keys := make([][]byte, len(pos))
+	for i, p := range pos {
+		keys[i] = lines[p]
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return rank(keys[i]) < rank(keys[j]) })
+	for i, p := range pos {
+		lines[p] = keys[i]
+	}
+}
+
+// titleBoolKeys are the top-level keys in the title block that hold a boolean.
+var titleBoolKeys = map[string]bool{
+	"consensus": true,
+}
+
+// titleBools returns the title block content with the values of the boolean keys normalized to true or
+// false. Values like "yes", "True" or "no" are recognized, other values are left alone.
+func titleBools(content []byte) []byte {
+	lines := bytes.Split(content, []byte("\n"))
+	for i, l := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(l), []byte("[")) {
+			break
+		}
+		m := titleKey.FindSubmatch(l)
+		if m == nil || !titleBoolKeys[string(m[1])] {
+			continue
+		}
+		value := bytes.ToLower(bytes.Trim(bytes.TrimSpace(m[2]), `"'`))
+		switch string(value) {
+		case "true", "yes":
+			lines[i] = []byte(string(m[1]) + " = true")
+		case "false", "no":
+			lines[i] = []byte(string(m[1]) + " = false")
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// multiline returns true if the TOML value continues on the next line.
+func multiline(value []byte) bool {
+	value = bytes.TrimSpace(value)
+	if bytes.HasPrefix(value, []byte(`"""`)) || bytes.HasPrefix(value, []byte(`'''`)) {
+		return true
+	}
+	return bytes.HasPrefix(value, []byte("[")) && !bytes.HasSuffix(value, []byte("]"))
+}
+
+// titleCheck validates the title block when ValidateCategory is set. The status of the seriesInfo is
+// the category of the RFC, an unknown value is recorded as an error.
+func (r *Renderer) titleCheck(t *mast.Title) {
+	if !r.opts.ValidateCategory || t.TitleData == nil {
+		return
+	}
+	status := t.SeriesInfo.Status
+	if status == "" {
+		return
+	}
+	if _, ok := xml.StatusToCategory[status]; !ok {
+		r.errs = append(r.errs, fmt.Errorf("unknown category (seriesInfo status) %q", status))
+	}
+}